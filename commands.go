@@ -0,0 +1,689 @@
+// This file implements the subcommands of the command line.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/bergmannf/rpgreminder/telegram"
+)
+
+const defaultConfigFile string = "/etc/rpgreminder/config.json"
+
+// How often the login command asks whether access was granted
+const loginPollInterval time.Duration = 2 * time.Second
+
+// Exit codes of the commands, so cron jobs and systemd timers can tell the
+// kind of failure apart.
+const (
+	exitOK = 0
+	// The command ran, but did not succeed, e.g. Nextcloud was not reachable
+	exitFailure = 1
+	// The command line was invalid
+	exitUsage = 2
+	// The configuration could not be loaded or is invalid
+	exitConfig = 3
+)
+
+// The arguments of the command are invalid
+type usageError struct{ error }
+
+// The configuration can not be used
+type configError struct{ error }
+
+type command struct {
+	name        string
+	description string
+	run         func(cmd *commandLine) error
+}
+
+// The state shared by all commands
+type commandLine struct {
+	flags      *flag.FlagSet
+	configFile string
+	// Positional arguments after parsing the flags
+	args []string
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "Run the Telegram bot", serve},
+		{"schedule", "Print the schedule of the next week or a time frame and optionally send it", schedule},
+		{"who", "Print who answered which option of the next week or a time frame", who},
+		{"stats", "Print how often every user is available in the next week or a time frame", stats},
+		{"cleanup", "Remove poll options in the past or before a date", cleanup},
+		{"extend", "Add new weekends to the end of the polls", extend},
+		{"export", "Write the chat log and poll history of all chats to files", export},
+		{"backup", "Write a backup of the database", backup},
+		{"restore", "Replace the database with a backup - stop the bot first", restore},
+		{"reencrypt", "Encrypt all stored messages with the current encryption key", reencrypt},
+		{"migrate", "Update the database schema to the current version", migrate},
+		{"login", "Get a Nextcloud app password in the browser and store it", login},
+		{"check-config", "Validate the configuration file", checkConfig},
+	}
+}
+
+// Run the command and return its exit code
+func runCommand(name string, configFile string, args []string) int {
+	index := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if index < 0 {
+		fmt.Fprintf(stderr, "Unknown command '%s'\n\n", name)
+		usage()
+		return exitUsage
+	}
+	cmd := &commandLine{flags: flag.NewFlagSet(name, flag.ContinueOnError), configFile: configFile, args: args}
+	cmd.flags.SetOutput(stderr)
+	cmd.flags.StringVar(&cmd.configFile, "c", configFile, "Configuration file for the bot")
+	err := commands[index].run(cmd)
+	var usageErr usageError
+	var configErr configError
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr):
+		fmt.Fprintln(stderr, "Invalid arguments:", err)
+		return exitUsage
+	case errors.As(err, &configErr):
+		fmt.Fprintln(stderr, "Invalid configuration:", err)
+		return exitConfig
+	}
+	fmt.Fprintln(stderr, "Failed:", err)
+	return exitFailure
+}
+
+// Parse the flags of the command. Unlike flag.Parse, flags may also follow
+// the positional arguments, e.g. `cleanup before 2026-10-01 --apply`.
+func (cmd *commandLine) parse() error {
+	args := cmd.args
+	cmd.args = []string{}
+	for {
+		err := cmd.flags.Parse(args)
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		if err != nil {
+			return usageError{err}
+		}
+		args = cmd.flags.Args()
+		if len(args) == 0 {
+			return nil
+		}
+		cmd.args = append(cmd.args, args[0])
+		args = args[1:]
+	}
+}
+
+// Load and validate the configuration
+func (cmd *commandLine) config() (*Config, error) {
+	config, err := loadConfiguration(cmd.configFile)
+	if err != nil {
+		return nil, configError{fmt.Errorf("could not load %s: %w", cmd.configFile, err)}
+	}
+	stderr.add(config.secrets()...)
+	err = config.Validate()
+	if err != nil {
+		return nil, configError{err}
+	}
+	return config, nil
+}
+
+// Load and validate the configuration. Chats use the polls created with
+// /newpoll instead of the configured ones, like in the bot.
+func (cmd *commandLine) pollConfig() (*Config, error) {
+	config, err := cmd.config()
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := telegram.ReadPollBindings(config.Telegram.Database)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the polls of the chats: %w", err)
+	}
+	config.Telegram.ChannelsToPolls = telegram.ApplyPollBindings(config.Telegram.ChannelsToPolls, bindings)
+	return config, nil
+}
+
+// The channels of the poll, or of all polls if pollId is 0. Only the first
+// channel of every poll is returned if unique is set, so changes to a poll
+// shared by several chats are only made once. Polls of different Nextcloud
+// accounts are different polls even if they have the same ID.
+func channelsOf(config *Config, account string, pollId int, unique bool) []telegram.ChannelPollMapping {
+	type poll struct {
+		account string
+		pollId  int
+	}
+	mappings := []telegram.ChannelPollMapping{}
+	seen := map[poll]bool{}
+	for _, mapping := range config.Telegram.ChannelsToPolls {
+		key := poll{mapping.Account, mapping.PollId}
+		if (pollId != 0 && mapping.PollId != pollId) || (account != "" && mapping.Account != account) || (unique && seen[key]) {
+			continue
+		}
+		seen[key] = true
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// Add the flags that select the polls a command works on
+func (cmd *commandLine) pollFlags(description string) (*string, *int) {
+	account := cmd.flags.String("account", "", "Only "+description+" the polls of this entry of nextcloud_accounts")
+	pollId := cmd.flags.Int("poll", 0, "Only "+description+" this poll")
+	return account, pollId
+}
+
+// Load the poll of the channel from its Nextcloud account
+func loadPoll(pool *nextcloud.Pool, mapping telegram.ChannelPollMapping) (*nextcloud.PollOptions, error) {
+	client, err := pool.Client(mapping.Account)
+	if err != nil {
+		return nil, err
+	}
+	return client.LoadPoll(mapping.PollId)
+}
+
+func serve(cmd *commandLine) error {
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	bot, err := telegram.NewBot(&config.Telegram, nextcloud.NewPool(config.NextcloudAccounts()))
+	if err != nil {
+		return err
+	}
+	go cmd.reloadOnHangup(bot)
+	bot.Setup()
+	return nil
+}
+
+// Reload the configuration file whenever SIGHUP is received, e.g. from
+// systemctl reload. An invalid file is reported and the bot keeps running
+// with the previous configuration.
+func (cmd *commandLine) reloadOnHangup(bot *telegram.TelegramBot) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		log.Print("Reloading ", cmd.configFile)
+		config, err := cmd.config()
+		if err != nil {
+			log.Print("Keeping the previous configuration: ", err)
+			continue
+		}
+		bot.Reload(&config.Telegram, config.NextcloudAccounts())
+	}
+}
+
+// Add the flags shared by the report commands
+func (cmd *commandLine) reportFlags(usage string) (*string, *int, *string) {
+	account, pollId := cmd.pollFlags("report")
+	output := cmd.flags.String("output", OUTPUT_TABLE, "Output format: "+strings.Join(outputFormats, ", "))
+	cmd.flags.Usage = func() {
+		fmt.Fprintln(cmd.flags.Output(), "Usage: rpgreminder "+usage)
+		cmd.flags.PrintDefaults()
+	}
+	return account, pollId, output
+}
+
+// Load the options of the time frame and the votes of every poll. Polls
+// shared by several chats are only reported once.
+func (cmd *commandLine) report(config *Config, pool *nextcloud.Pool, account string, pollId int) (*Report, error) {
+	from, to, err := telegram.ParseScheduleArgs(cmd.args, time.Now())
+	if err != nil {
+		return nil, usageError{err}
+	}
+	polls := channelsOf(config, account, pollId, true)
+	if len(polls) == 0 {
+		return nil, usageError{errors.New("no chat uses the selected polls")}
+	}
+	report := &Report{SchemaVersion: reportSchemaVersion, From: from.UTC(), To: to.UTC(), Polls: []PollReport{}}
+	for _, mapping := range polls {
+		client, err := pool.Client(mapping.Account)
+		if err != nil {
+			return nil, err
+		}
+		poll, err := client.LoadPoll(mapping.PollId)
+		if err != nil {
+			return nil, err
+		}
+		votes, err := client.Votes(mapping.PollId)
+		if err != nil {
+			return nil, err
+		}
+		report.Polls = append(report.Polls, pollReport(mapping, nextcloud.OptionsBetween(poll, from, to), votes))
+	}
+	return report, nil
+}
+
+// Print a report table of all polls
+func printReport(cmd *commandLine, usage string, table reportTable) error {
+	account, pollId, output := cmd.reportFlags(usage)
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return usageError{err}
+	}
+	config, err := cmd.pollConfig()
+	if err != nil {
+		return err
+	}
+	report, err := cmd.report(config, nextcloud.NewPool(config.NextcloudAccounts()), *account, *pollId)
+	if err != nil {
+		return err
+	}
+	return report.Write(os.Stdout, format, table)
+}
+
+func schedule(cmd *commandLine) error {
+	send := cmd.flags.Bool("send", false, "Send the schedule to the chats of the poll")
+	account, pollId, output := cmd.reportFlags("schedule [--account NAME] [--poll N] [--output FORMAT] [--send] [3w|2026-11-01..2026-11-30]")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	format, err := parseOutputFormat(*output)
+	if err != nil {
+		return usageError{err}
+	}
+	config, err := cmd.pollConfig()
+	if err != nil {
+		return err
+	}
+	pool := nextcloud.NewPool(config.NextcloudAccounts())
+	report, err := cmd.report(config, pool, *account, *pollId)
+	if err != nil {
+		return err
+	}
+	err = report.Write(os.Stdout, format, scheduleTable)
+	if err != nil || !*send {
+		return err
+	}
+	bot, err := telegram.NewCommandLineBot(&config.Telegram, pool)
+	if err != nil {
+		return err
+	}
+	for _, mapping := range channelsOf(config, *account, *pollId, true) {
+		options, err := loadPoll(pool, mapping)
+		if err != nil {
+			return err
+		}
+		table := telegram.ScheduleTable(nextcloud.OptionsBetween(options, report.From, report.To))
+		for _, channel := range channelsOf(config, mapping.Account, mapping.PollId, false) {
+			err = bot.SendNow(channel.ChannelId, table, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Print who answered which option of the time frame
+func who(cmd *commandLine) error {
+	return printReport(cmd, "who [--account NAME] [--poll N] [--output FORMAT] [3w|2026-11-01..2026-11-30]", whoTable)
+}
+
+// Print how often every user is available in the time frame
+func stats(cmd *commandLine) error {
+	return printReport(cmd, "stats [--account NAME] [--poll N] [--output FORMAT] [3w|2026-11-01..2026-11-30]", statsTable)
+}
+
+// Print the planned changes or apply them if requested. Fails if not all
+// changes could be applied, the remaining ones are retried by the bot.
+func applyChanges(config *Config, pool *nextcloud.Pool, changes []telegram.OutboxEntry, apply bool) error {
+	if len(changes) == 0 {
+		fmt.Println("Nothing to change.")
+		return nil
+	}
+	if !apply {
+		for _, change := range changes {
+			fmt.Printf("Poll %d: would %s\n", change.PollId, change.String())
+		}
+		fmt.Println("Use --apply to change the polls.")
+		return nil
+	}
+	db, err := telegram.OpenExisting(&config.Telegram)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Println(telegram.NewOutbox(db, pool).Queue(changes))
+	unapplied := 0
+	for _, change := range changes {
+		if change.Status != telegram.APPLIED {
+			unapplied++
+		}
+	}
+	if unapplied > 0 {
+		return fmt.Errorf("%d of %d changes were not applied", unapplied, len(changes))
+	}
+	return nil
+}
+
+func cleanup(cmd *commandLine) error {
+	account, pollId := cmd.pollFlags("clean up")
+	apply := cmd.flags.Bool("apply", false, "Remove the options instead of only printing them")
+	cmd.flags.Usage = func() {
+		fmt.Fprintln(cmd.flags.Output(), "Usage: rpgreminder cleanup [--account NAME] [--poll N] [--apply] [before 2026-10-01]")
+		cmd.flags.PrintDefaults()
+	}
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	before, err := telegram.ParseCleanupArgs(cmd.args, time.Now())
+	if err != nil {
+		return usageError{err}
+	}
+	config, err := cmd.pollConfig()
+	if err != nil {
+		return err
+	}
+	pool := nextcloud.NewPool(config.NextcloudAccounts())
+	changes := []telegram.OutboxEntry{}
+	for _, mapping := range channelsOf(config, *account, *pollId, true) {
+		poll, err := loadPoll(pool, mapping)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, telegram.PlanCleanup(poll, mapping, before)...)
+	}
+	return applyChanges(config, pool, changes, *apply)
+}
+
+func extend(cmd *commandLine) error {
+	account, pollId := cmd.pollFlags("extend")
+	weekends := cmd.flags.Int("weeks", telegram.DefaultExtendWeekends, "Number of weekends to add")
+	apply := cmd.flags.Bool("apply", false, "Add the options instead of only printing them")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	if len(cmd.args) > 0 {
+		return usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(cmd.args, " "))}
+	}
+	err = telegram.ValidateWeekends(*weekends)
+	if err != nil {
+		return usageError{err}
+	}
+	config, err := cmd.pollConfig()
+	if err != nil {
+		return err
+	}
+	pool := nextcloud.NewPool(config.NextcloudAccounts())
+	changes := []telegram.OutboxEntry{}
+	for _, mapping := range channelsOf(config, *account, *pollId, true) {
+		poll, err := loadPoll(pool, mapping)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, telegram.PlanExtend(poll, mapping, *weekends)...)
+	}
+	return applyChanges(config, pool, changes, *apply)
+}
+
+// Write the chat log and poll history of every configured chat into the
+// directory, e.g. to back up a campaign outside of Telegram.
+func export(cmd *commandLine) error {
+	dir := cmd.flags.String("dir", ".", "Directory the exports are written to")
+	cmd.flags.Usage = func() {
+		fmt.Fprintln(cmd.flags.Output(), "Usage: rpgreminder export [--dir DIR] [json|md|csv] [3w|2026-10-01|2026-10-01..2026-10-31]")
+		cmd.flags.PrintDefaults()
+	}
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	format, since, until, err := telegram.ParseExportArgs(cmd.args, time.Now())
+	if err != nil {
+		return usageError{err}
+	}
+	config, err := cmd.pollConfig()
+	if err != nil {
+		return err
+	}
+	db, err := telegram.OpenExisting(&config.Telegram)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	for _, mapping := range config.Telegram.ChannelsToPolls {
+		export, err := db.Export(mapping.ChannelId, mapping.PollId, since, until)
+		if err != nil {
+			return fmt.Errorf("could not export chat %d: %w", mapping.ChannelId, err)
+		}
+		var content bytes.Buffer
+		err = export.Write(&content, format)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(*dir, export.FileName(format))
+		err = os.WriteFile(path, content.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Exported %d messages of %d to %s\n", len(export.Messages), mapping.ChannelId, path)
+	}
+	return nil
+}
+
+// Write a backup of the database. Old backups are removed like the
+// scheduled ones.
+func backup(cmd *commandLine) error {
+	dir := cmd.flags.String("dir", "", "Directory the backup is written to - defaults to telegram.backup.directory")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	backup := config.Telegram.Backup
+	if *dir != "" {
+		backup.Directory = *dir
+	}
+	if backup.Directory == "" {
+		return usageError{errors.New("use --dir or set telegram.backup.directory")}
+	}
+	// The bot may be running with an older schema, so the database is copied
+	// as it is.
+	db, err := telegram.OpenReadOnly(config.Telegram.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	path, err := db.BackupTo(backup, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Println("Backed up the database to", path)
+	return nil
+}
+
+func restore(cmd *commandLine) error {
+	cmd.flags.Usage = func() {
+		fmt.Fprintln(cmd.flags.Output(), "Usage: rpgreminder restore <backup file>")
+	}
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	if len(cmd.args) != 1 {
+		return usageError{errors.New("use rpgreminder restore <backup file>")}
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	err = telegram.RestoreBackup(cmd.args[0], config.Telegram.Database)
+	if errors.Is(err, telegram.ErrDatabaseInUse) {
+		return fmt.Errorf("%w, stop the bot before restoring the database", err)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println("Restored the database from", cmd.args[0])
+	return nil
+}
+
+// Rewrite all stored messages with the primary encryption key, so keys listed
+// in previous_key_files can be removed afterwards.
+func reencrypt(cmd *commandLine) error {
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	cipher, err := telegram.LoadCipher(config.Telegram.Encryption)
+	if err != nil {
+		return configError{fmt.Errorf("could not load the encryption key: %w", err)}
+	}
+	if cipher == nil {
+		return configError{errors.New("no encryption key is configured")}
+	}
+	count, err := telegram.ReEncryptDatabase(config.Telegram.Database, cipher)
+	if errors.Is(err, telegram.ErrDatabaseInUse) {
+		return fmt.Errorf("%w, stop the bot before re-encrypting the database", err)
+	}
+	if err != nil {
+		return fmt.Errorf("could not re-encrypt messages: %w", err)
+	}
+	log.Print("Re-encrypted ", count, " rows")
+	return nil
+}
+
+func migrate(cmd *commandLine) error {
+	status := cmd.flags.Bool("status", false, "Only print the schema version, fails if migrations are pending")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	if *status {
+		version, err := telegram.DatabaseSchemaVersion(config.Telegram.Database)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Schema version %d of %d\n", version, telegram.LatestSchemaVersion())
+		if version < telegram.LatestSchemaVersion() {
+			return fmt.Errorf("%d migrations are pending", telegram.LatestSchemaVersion()-version)
+		}
+		return nil
+	}
+	db, err := telegram.OpenDatabase(config.Telegram.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Printf("Schema version %d\n", telegram.LatestSchemaVersion())
+	return nil
+}
+
+func checkConfig(cmd *commandLine) error {
+	show := cmd.flags.Bool("print", false, "Print the configuration including the environment variables, without secrets")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	config, err := cmd.config()
+	if err != nil {
+		return err
+	}
+	if *show {
+		return printConfiguration(os.Stdout, config)
+	}
+	fmt.Println(cmd.configFile, "is valid")
+	return nil
+}
+
+// Get an app password with the login flow of Nextcloud - the user opens the
+// printed page and grants access. The username and password are written to
+// the account in the configuration file, or the password to --token-file.
+func login(cmd *commandLine) error {
+	account := cmd.flags.String("account", nextcloud.DEFAULT_ACCOUNT, "Log in to this entry of nextcloud_accounts instead of the nextcloud section")
+	server := cmd.flags.String("server", "", "Nextcloud server like https://cloud.example.com - defaults to the server of the account")
+	tokenFile := cmd.flags.String("token-file", "", "Write the app password to this file instead of the configuration, e.g. the one in RPGREMINDER_NEXTCLOUD_TOKEN_FILE")
+	err := cmd.parse()
+	if err != nil {
+		return err
+	}
+	if len(cmd.args) > 0 {
+		return usageError{fmt.Errorf("unexpected arguments: %s", strings.Join(cmd.args, " "))}
+	}
+	// Not validated, as the token is usually missing or revoked.
+	config, err := loadConfiguration(cmd.configFile)
+	if err != nil {
+		return configError{fmt.Errorf("could not load %s: %w", cmd.configFile, err)}
+	}
+	stderr.add(config.secrets()...)
+	options := nextcloud.NextcloudConfig{}
+	for _, candidate := range config.NextcloudAccounts() {
+		if candidate.Name == *account {
+			options = candidate
+		}
+	}
+	if *server != "" {
+		options.Server = strings.TrimRight(*server, "/")
+	}
+	if options.Server == "" {
+		return usageError{errors.New("the account has no server yet, use --server")}
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ctx, cancelLogin := context.WithTimeout(ctx, nextcloud.LoginFlowTimeout)
+	defer cancelLogin()
+	flow, err := nextcloud.StartLogin(ctx, options)
+	if err != nil {
+		return fmt.Errorf("could not start the login on %s: %w", options.Server, err)
+	}
+	fmt.Println("Open this page and grant access to the bot:")
+	fmt.Println(flow.Login)
+	fmt.Fprintln(stderr, "Waiting for the login to complete...")
+	result, err := flow.Wait(ctx, loginPollInterval)
+	if err != nil {
+		return fmt.Errorf("the login was not completed: %w", err)
+	}
+	stderr.add(result.AppPassword)
+
+	settings := []setting{{"server", options.Server}, {"username", result.LoginName}}
+	if *tokenFile != "" {
+		err = writeFileAtomically(*tokenFile, []byte(result.AppPassword+"\n"))
+		if err != nil {
+			return err
+		}
+	} else {
+		settings = append(settings, setting{"token", result.AppPassword})
+	}
+	err = updateAccount(cmd.configFile, *account, settings)
+	if err != nil {
+		return fmt.Errorf("could not update %s: %w", cmd.configFile, err)
+	}
+	fmt.Println("Logged in as", result.LoginName, "- reload the bot to use the new app password")
+	return nil
+}
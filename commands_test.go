@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/bergmannf/rpgreminder/telegram"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write configuration: %v", err)
+	}
+	return path
+}
+
+func TestExitCodes(t *testing.T) {
+	valid := writeConfig(t, `{
+		"telegram": {"token": "token", "database_path": "`+filepath.Join(t.TempDir(), "messages.db")+`", "channels": [{"id": -1001, "pollid": 3}]},
+		"nextcloud": {"server": "https://cloud.example.com", "username": "bot", "token": "token"}
+	}`)
+	invalid := writeConfig(t, `{"telegram": {"channels": [{"id": -1001}]}, "nextcloud": {"server": "cloud"}}`)
+
+	assert.Equal(t, exitOK, runCommand("check-config", valid, nil))
+	assert.Equal(t, exitConfig, runCommand("check-config", invalid, nil))
+	assert.Equal(t, exitConfig, runCommand("check-config", "missing.json", nil))
+	assert.Equal(t, exitUsage, runCommand("unknown", valid, nil))
+	assert.Equal(t, exitUsage, runCommand("extend", valid, []string{"--weeks", "100"}))
+	assert.Equal(t, exitUsage, runCommand("cleanup", valid, []string{"after", "2026-01-01"}))
+	assert.Equal(t, exitOK, runCommand("migrate", valid, nil))
+	assert.Equal(t, exitOK, runCommand("migrate", valid, []string{"--status"}))
+	// The configuration file can also be passed after the command
+	assert.Equal(t, exitOK, runCommand("check-config", "missing.json", []string{"-c", valid}))
+}
+
+func TestParseInterspersedFlags(t *testing.T) {
+	cmd := &commandLine{flags: flag.NewFlagSet("cleanup", flag.ContinueOnError), args: []string{"before", "--apply", "2026-10-01"}}
+	apply := cmd.flags.Bool("apply", false, "")
+	assert.NoError(t, cmd.parse())
+	assert.True(t, *apply)
+	assert.Equal(t, []string{"before", "2026-10-01"}, cmd.args)
+}
+
+func TestDecodeConfiguration(t *testing.T) {
+	yamlConfig := `
+telegram:
+  token: token
+  channels:
+    - id: -1001
+      pollid: 3
+      retention:
+        max_age_days: 30
+nextcloud:
+  server: https://cloud.example.com
+`
+	config, err := decodeConfiguration([]byte(yamlConfig), true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-1001), config.Telegram.ChannelsToPolls[0].ChannelId)
+	assert.Equal(t, 30, config.Telegram.ChannelsToPolls[0].Retention.MaxAgeDays)
+	assert.Equal(t, "https://cloud.example.com", config.Nextcloud.Server)
+
+	_, err = decodeConfiguration([]byte(`{"telegram": {"channel": 1}}`), false)
+	assert.EqualError(t, err, `unknown field "channel"`)
+	_, err = decodeConfiguration([]byte("telegram:\n  poll_id: 3\n"), true)
+	assert.EqualError(t, err, `unknown field "poll_id"`)
+	_, err = decodeConfiguration([]byte(`{"telegram": {}} {}`), false)
+	assert.Error(t, err)
+	_, err = decodeConfiguration([]byte(`{"telegram": {"token": "a" "database_path": "b"}}`), false)
+	assert.Error(t, err)
+}
+
+func TestSampleConfigurations(t *testing.T) {
+	for _, path := range []string{"config.sample.json", "config.sample.yaml"} {
+		config, err := loadConfiguration(path)
+		assert.NoError(t, err, path)
+		assert.NoError(t, config.Validate(), path)
+	}
+}
+
+func TestValidateAccounts(t *testing.T) {
+	account := nextcloud.NextcloudConfig{Server: "https://cloud.example.com", Username: "bot", Token: "token"}
+	club := account
+	club.Name = "club"
+	config := &Config{
+		Accounts: []nextcloud.NextcloudConfig{club},
+		Telegram: telegram.TelegramConfig{Token: "token", Database: filepath.Join(t.TempDir(), "messages.db"), ChannelsToPolls: []telegram.ChannelPollMapping{{ChannelId: 1, PollId: 3, Account: "club"}}},
+	}
+	// The nextcloud section is not needed if no chat uses it
+	assert.NoError(t, config.Validate())
+	assert.Equal(t, []nextcloud.NextcloudConfig{club}, config.NextcloudAccounts())
+
+	config.Telegram.ChannelsToPolls = append(config.Telegram.ChannelsToPolls, telegram.ChannelPollMapping{ChannelId: 2, PollId: 3, Account: "other"})
+	config.Accounts = append(config.Accounts, club, account)
+	err := config.Validate()
+	assert.ErrorContains(t, err, "nextcloud_accounts[1].name 'club' is used twice")
+	assert.ErrorContains(t, err, "nextcloud_accounts[2].name is not set")
+	assert.ErrorContains(t, err, "telegram.channels[1].nextcloud_account 'other' is not in nextcloud_accounts")
+	assert.NotContains(t, err.Error(), "nextcloud.server")
+
+	config.Telegram.ChannelsToPolls = append(config.Telegram.ChannelsToPolls, telegram.ChannelPollMapping{ChannelId: 3, PollId: 4})
+	assert.ErrorContains(t, config.Validate(), "nextcloud.server is not set")
+}
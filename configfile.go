@@ -0,0 +1,201 @@
+// This file changes settings in the configuration file, e.g. after a login.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"gopkg.in/yaml.v3"
+)
+
+// A setting written to the configuration file
+type setting struct {
+	key   string
+	value string
+}
+
+func isYAMLFile(path string) bool {
+	extension := strings.ToLower(filepath.Ext(path))
+	return extension == ".yaml" || extension == ".yml"
+}
+
+// The value of the key in the mapping, nil if it is not set
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// The value of the key in the mapping, added with the kind if it is not set
+func mappingChild(mapping *yaml.Node, key string, kind yaml.Kind) (*yaml.Node, error) {
+	value := mappingValue(mapping, key)
+	if value == nil || (value.Kind == yaml.ScalarNode && value.Tag == "!!null") {
+		if value == nil {
+			value = &yaml.Node{}
+			mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+		}
+		*value = yaml.Node{Kind: kind}
+	}
+	if value.Kind != kind {
+		return nil, fmt.Errorf("%s has an unexpected type", key)
+	}
+	return value, nil
+}
+
+// The mapping of the account in the document, added if it does not exist
+func accountNode(root *yaml.Node, account string) (*yaml.Node, error) {
+	if account == nextcloud.DEFAULT_ACCOUNT {
+		return mappingChild(root, "nextcloud", yaml.MappingNode)
+	}
+	accounts, err := mappingChild(root, "nextcloud_accounts", yaml.SequenceNode)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range accounts.Content {
+		if name := mappingValue(entry, "name"); entry.Kind == yaml.MappingNode && name != nil && name.Value == account {
+			return entry, nil
+		}
+	}
+	entry := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: "name"},
+		{Kind: yaml.ScalarNode, Tag: "!!str", Value: account},
+	}}
+	accounts.Content = append(accounts.Content, entry)
+	return entry, nil
+}
+
+// Write the node as JSON, keeping the order of the keys
+func writeJSON(out *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		out.WriteByte('{')
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			out.Write(key)
+			out.WriteByte(':')
+			err = writeJSON(out, node.Content[i+1])
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case yaml.SequenceNode:
+		out.WriteByte('[')
+		for i, item := range node.Content {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			err := writeJSON(out, item)
+			if err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case yaml.AliasNode:
+		return writeJSON(out, node.Alias)
+	default:
+		var value any
+		err := node.Decode(&value)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		out.Write(encoded)
+	}
+	return nil
+}
+
+// Change settings of the Nextcloud account in the configuration file. The
+// order of the settings and the comments of YAML files are kept.
+func updateAccount(path string, account string, settings []setting) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// JSON is valid YAML, so both formats are edited the same way.
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return err
+	}
+	if document.Kind == 0 {
+		document = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New("the configuration is not a mapping")
+	}
+	node, err := accountNode(root, account)
+	if err != nil {
+		return err
+	}
+	for _, s := range settings {
+		value, err := mappingChild(node, s.key, yaml.ScalarNode)
+		if err != nil {
+			return err
+		}
+		value.Tag, value.Value, value.Style = "!!str", s.value, 0
+	}
+
+	var out bytes.Buffer
+	if isYAMLFile(path) {
+		encoder := yaml.NewEncoder(&out)
+		encoder.SetIndent(2)
+		err = encoder.Encode(&document)
+	} else {
+		var compact bytes.Buffer
+		err = writeJSON(&compact, root)
+		if err == nil {
+			err = json.Indent(&out, compact.Bytes(), "", "    ")
+			out.WriteByte('\n')
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(path, out.Bytes())
+}
+
+// Replace the file, so the bot never reads a partly written one. The
+// permissions of an existing file are kept, new files are only readable by
+// the owner.
+func writeFileAtomically(path string, content []byte) error {
+	mode := os.FileMode(0o600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	temp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(content)
+	if err == nil {
+		err = temp.Chmod(mode)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
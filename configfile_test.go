@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateAccountYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(`telegram:
+  token: bottoken # from BotFather
+nextcloud:
+  server: https://cloud.example.com
+  username: old
+  token: old
+`), 0o640))
+
+	assert.NoError(t, updateAccount(path, "", []setting{{"username", "rpgbot"}, {"token", "12345"}}))
+	assert.NoError(t, updateAccount(path, "club", []setting{{"server", "https://club.example.com"}, {"token", "secret"}}))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `telegram:
+  token: bottoken # from BotFather
+nextcloud:
+  server: https://cloud.example.com
+  username: rpgbot
+  token: "12345"
+nextcloud_accounts:
+  - name: club
+    server: https://club.example.com
+    token: secret
+`, string(content))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+}
+
+func TestUpdateAccountJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"telegram": {"token": "bottoken", "channels": [{"id": -1001234567890, "pollid": 1, "notify": true}]},
+"nextcloud_accounts": [{"name": "club", "server": "https://club.example.com", "cache_ttl": 60}]}`), 0o600))
+
+	assert.NoError(t, updateAccount(path, "club", []setting{{"username", "rpgbot"}, {"token", "secret"}}))
+	content, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, `{
+    "telegram": {
+        "token": "bottoken",
+        "channels": [
+            {
+                "id": -1001234567890,
+                "pollid": 1,
+                "notify": true
+            }
+        ]
+    },
+    "nextcloud_accounts": [
+        {
+            "name": "club",
+            "server": "https://club.example.com",
+            "cache_ttl": 60,
+            "username": "rpgbot",
+            "token": "secret"
+        }
+    ]
+}
+`, string(content))
+	config, err := loadConfiguration(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", config.Accounts[0].Token)
+}
+
+func TestLogin(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/index.php/login/v2":
+			w.Write([]byte(`{"poll": {"token": "poll-token", "endpoint": "` + server.URL + `/login/v2/poll"}, "login": "` + server.URL + `/login/v2/flow/abc"}`))
+		case "/login/v2/poll":
+			w.Write([]byte(`{"server": "` + server.URL + `", "loginName": "rpgbot", "appPassword": "app-password"}`))
+		}
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	assert.NoError(t, os.WriteFile(configFile, []byte("telegram:\n  token: bottoken\n"), 0o600))
+
+	assert.Equal(t, exitUsage, runCommand("login", configFile, []string{"--account", "club"}))
+	assert.Equal(t, exitOK, runCommand("login", configFile, []string{"--account", "club", "--server", server.URL + "/"}))
+	config, err := loadConfiguration(configFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "club", config.Accounts[0].Name)
+	assert.Equal(t, server.URL, config.Accounts[0].Server)
+	assert.Equal(t, "rpgbot", config.Accounts[0].Username)
+	assert.Equal(t, "app-password", config.Accounts[0].Token)
+
+	tokenFile := filepath.Join(dir, "token")
+	assert.Equal(t, exitOK, runCommand("login", configFile, []string{"--account", "club", "--token-file", tokenFile}))
+	token, err := os.ReadFile(tokenFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "app-password\n", string(token))
+}
@@ -0,0 +1,240 @@
+// This file applies settings from environment variables and keeps secrets
+// out of the logs.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bergmannf/rpgreminder/telegram"
+)
+
+// Every setting of the configuration can be overridden with a variable
+// named after its path, e.g. RPGREMINDER_TELEGRAM_DATABASE_PATH or
+// RPGREMINDER_TELEGRAM_CHANNELS_0_POLLID. Lists and objects can also be
+// replaced as a whole with a JSON value, e.g.
+// RPGREMINDER_TELEGRAM_CHANNELS='[{"id": -1001, "pollid": 3}]'. Appending
+// _FILE reads the value from the file instead, for Docker secrets and
+// systemd credentials.
+const envPrefix string = "RPGREMINDER_"
+
+const fileSuffix string = "_FILE"
+
+// Variables with the prefix that are read where they are used instead of
+// being settings of the configuration
+var ownVariables = []string{telegram.EncryptionKeyEnv}
+
+// Chats and key files are limited, so a typo does not allocate a huge list
+const maxEnvIndex int = 1000
+
+const redacted string = "[REDACTED]"
+
+// Shorter values are placeholders, replacing them would garble every line
+const minSecretLength int = 4
+
+// Read a secret from a file - the trailing newline most editors add is not
+// part of the secret.
+func readSecretFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Read the variable or the file named by the variable with the _FILE suffix
+func secretFromEnvironment(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	if path := os.Getenv(name + fileSuffix); path != "" {
+		value, err := readSecretFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", name+fileSuffix, err)
+		}
+		return value, nil
+	}
+	return "", nil
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	return strings.ToUpper(name)
+}
+
+// Find the setting named by the variable without the prefix. Lists grow to
+// the index that is used.
+func lookupSetting(v reflect.Value, name string) (reflect.Value, error) {
+	for name != "" {
+		switch v.Kind() {
+		case reflect.Struct:
+			// The longest name wins, so "key_file" is not taken for "key".
+			match, key := -1, ""
+			for i := 0; i < v.NumField(); i++ {
+				candidate := jsonName(v.Type().Field(i))
+				if candidate == "" || candidate == "-" || len(candidate) <= len(key) {
+					continue
+				}
+				if name == candidate || strings.HasPrefix(name, candidate+"_") {
+					match, key = i, candidate
+				}
+			}
+			if match < 0 {
+				return reflect.Value{}, fmt.Errorf("unknown setting %s", name)
+			}
+			v, name = v.Field(match), strings.TrimPrefix(name[len(key):], "_")
+		case reflect.Slice:
+			part, rest, _ := strings.Cut(name, "_")
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= maxEnvIndex {
+				return reflect.Value{}, fmt.Errorf("%s is not an index below %d", part, maxEnvIndex)
+			}
+			if index >= v.Len() {
+				v.Set(reflect.AppendSlice(v, reflect.MakeSlice(v.Type(), index+1-v.Len(), index+1-v.Len())))
+			}
+			v, name = v.Index(index), rest
+		default:
+			return reflect.Value{}, fmt.Errorf("unknown setting %s", name)
+		}
+	}
+	return v, nil
+}
+
+func setSetting(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(i)
+	default:
+		decoded := reflect.New(v.Type())
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(decoded.Interface())
+		if err != nil {
+			return fmt.Errorf("invalid JSON value: %s", strings.TrimPrefix(err.Error(), "json: "))
+		}
+		v.Set(decoded.Elem())
+	}
+	return nil
+}
+
+// Apply all RPGREMINDER_ variables of the environment to the configuration
+func applyEnvironment(config *Config, environ []string) error {
+	// Sorted, so lists are always filled in the same order.
+	slices.Sort(environ)
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		setting, ok := strings.CutPrefix(name, envPrefix)
+		if !ok || slices.Contains(ownVariables, name) {
+			continue
+		}
+		field, err := lookupSetting(reflect.ValueOf(config).Elem(), setting)
+		if err != nil && strings.HasSuffix(setting, fileSuffix) {
+			field, err = lookupSetting(reflect.ValueOf(config).Elem(), strings.TrimSuffix(setting, fileSuffix))
+			if err == nil {
+				value, err = readSecretFile(value)
+			}
+		}
+		if err == nil {
+			err = setSetting(field, value)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// The secrets of the configuration that must not show up in the logs
+func (c *Config) secrets() []string {
+	secrets := []string{c.Telegram.Token, c.Nextcloud.Token, c.Nextcloud.HTTP.ProxyPassword()}
+	for _, account := range c.Accounts {
+		secrets = append(secrets, account.Token, account.HTTP.ProxyPassword())
+	}
+	return secrets
+}
+
+// A copy of the configuration that can be printed
+func (c *Config) redacted() Config {
+	safe := *c
+	if safe.Telegram.Token != "" {
+		safe.Telegram.Token = redacted
+	}
+	if safe.Nextcloud.Token != "" {
+		safe.Nextcloud.Token = redacted
+	}
+	safe.Nextcloud.HTTP.Proxy = safe.Nextcloud.HTTP.RedactedProxy()
+	safe.Accounts = slices.Clone(c.Accounts)
+	for i := range safe.Accounts {
+		if safe.Accounts[i].Token != "" {
+			safe.Accounts[i].Token = redacted
+		}
+		safe.Accounts[i].HTTP.Proxy = safe.Accounts[i].HTTP.RedactedProxy()
+	}
+	return safe
+}
+
+// Replaces all known secrets in everything written to it
+type redactor struct {
+	lock     sync.Mutex
+	out      io.Writer
+	secrets  []string
+	replacer *strings.Replacer
+}
+
+// Everything the commands print to stderr, including the log, passes the
+// redactor.
+var stderr = &redactor{out: os.Stderr}
+
+func (r *redactor) add(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= minSecretLength && !slices.Contains(r.secrets, secret) {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+	pairs := []string{}
+	for _, secret := range r.secrets {
+		pairs = append(pairs, secret, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.replacer == nil {
+		return r.out.Write(p)
+	}
+	_, err := io.WriteString(r.out, r.replacer.Replace(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Print the configuration as JSON without its secrets
+func printConfiguration(w io.Writer, config *Config) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(config.redacted())
+}
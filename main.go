@@ -1,104 +1,155 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strings"
 
 	"github.com/bergmannf/rpgreminder/nextcloud"
 	"github.com/bergmannf/rpgreminder/telegram"
+	"gopkg.in/yaml.v3"
 )
 
-var msgs []string
-
 type Config struct {
+	// The account used by chats without a nextcloud_account
 	Nextcloud nextcloud.NextcloudConfig `json:"nextcloud"`
-	Telegram  telegram.TelegramConfig   `json:"telegram"`
+	// Further accounts, e.g. on other servers, referenced by their name
+	Accounts []nextcloud.NextcloudConfig `json:"nextcloud_accounts"`
+	Telegram telegram.TelegramConfig     `json:"telegram"`
 }
 
-// Load the configuration from the config file - will extend the sensitive
-// information from env variables if needed:
-// - NEXTCLOUD_TOKEN
-// - TELEGRAM_TOKEN
-func loadConfiguration(path string) (*Config, error) {
+// Decode the configuration and fail on unknown fields, so typos do not go
+// unnoticed. YAML is converted to JSON first, so the json tags of the structs
+// are used for both formats.
+func decodeConfiguration(content []byte, yamlFormat bool) (*Config, error) {
+	if yamlFormat {
+		var document any
+		err := yaml.Unmarshal(content, &document)
+		if err != nil {
+			return nil, err
+		}
+		content, err = json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+	}
 	var opts Config
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&opts)
+	if err != nil {
+		// The errors mention JSON even if the file is YAML.
+		return nil, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected content after the configuration")
+	}
+	return &opts, nil
+}
+
+// Load the configuration from the config file - files ending in .yaml or
+// .yml are read as YAML, all others as JSON. RPGREMINDER_ variables override
+// the settings of the file, see envPrefix. The tokens are also read from
+// these variables if they are not set otherwise:
+// - NEXTCLOUD_TOKEN or NEXTCLOUD_TOKEN_FILE
+// - TELEGRAM_TOKEN or TELEGRAM_TOKEN_FILE
+func loadConfiguration(path string) (*Config, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(content, &opts)
+	opts, err := decodeConfiguration(content, isYAMLFile(path))
+	if err != nil {
+		return nil, err
+	}
+	err = applyEnvironment(opts, os.Environ())
 	if err != nil {
 		return nil, err
 	}
 	if opts.Nextcloud.Token == "" {
-		opts.Nextcloud.Token = os.Getenv("NEXTCLOUD_TOKEN")
+		opts.Nextcloud.Token, err = secretFromEnvironment("NEXTCLOUD_TOKEN")
+		if err != nil {
+			return nil, err
+		}
 	}
 	if opts.Telegram.Token == "" {
-		opts.Telegram.Token = os.Getenv("TELEGRAM_TOKEN")
+		opts.Telegram.Token, err = secretFromEnvironment("TELEGRAM_TOKEN")
+		if err != nil {
+			return nil, err
+		}
 	}
-	return &opts, nil
+	return opts, nil
 }
 
-func main() {
-	batchMode := flag.Bool("b", false, "Run the bot in batch mode instead of interactive")
-	configFile := flag.String("c", "/etc/rpgreminder/config.json", "Configuration file for the bot")
-	pollId := flag.Int("p", 1, "PollID to use for batch mode commands")
-	flag.Parse()
-	config, err := loadConfiguration(*configFile)
-	if err != nil {
-		fmt.Println("Could not load configuration: ", *configFile, err.Error())
-		os.Exit(1)
+// All configured Nextcloud accounts, the nextcloud section is the one without
+// a name.
+func (c *Config) NextcloudAccounts() []nextcloud.NextcloudConfig {
+	accounts := []nextcloud.NextcloudConfig{}
+	if c.Nextcloud.Server != "" {
+		account := c.Nextcloud
+		account.Name = nextcloud.DEFAULT_ACCOUNT
+		accounts = append(accounts, account)
 	}
+	return append(accounts, c.Accounts...)
+}
 
-	// NEXTCLOUD SETUP
-	nextcloudClient := nextcloud.FromConfig(config.Nextcloud)
-
-	// Telegram
-	bot, err := telegram.NewBot(&config.Telegram, &nextcloudClient)
-	if err != nil {
-		log.Fatal("Could not create Telegram bot - exiting")
-		return
+// Check the parts of the configuration every command needs
+func (c *Config) Validate() error {
+	errs := []error{c.Telegram.Validate()}
+	defaultUsed := c.Nextcloud.Server != "" || c.Nextcloud.Username != "" || c.Nextcloud.Token != ""
+	for _, mapping := range c.Telegram.ChannelsToPolls {
+		defaultUsed = defaultUsed || mapping.Account == nextcloud.DEFAULT_ACCOUNT
 	}
-	if *batchMode {
-		opts, err := nextcloudClient.LoadPoll(*pollId)
-		if err != nil {
-			return
-		}
-		weekend := nextcloud.NextWeekend(opts)
-		formatStringHeader := "| %-10s | %-5s | %5s | %5s | %5s | %8s |"
-		formatStringOption := "| %-10s | %-5s | %5d | %5d | %5d | %6.2f %% |"
-		msgs := []string{fmt.Sprintf(formatStringHeader, "Weekday", "Date", "Yes", "No", "Maybe", "Total")}
-		for _, opt := range weekend {
-			timeVotes := opt.Votes.Yes + opt.Votes.Maybe
-			allVotes := opt.Votes.Yes + opt.Votes.Maybe + opt.Votes.No
-			percent := (float32(timeVotes) / float32(allVotes)) * 100
-			msg := fmt.Sprintf(formatStringOption,
-				opt.Datetime().Weekday(),
-				opt.Datetime().Format("02/01"),
-				opt.Votes.Yes,
-				opt.Votes.Maybe,
-				opt.Votes.No,
-				percent,
-			)
-			msgs = append(msgs, msg)
-		}
-		for _, msg := range msgs {
-			log.Print(msg)
-		}
-		deletionOptions := nextcloud.DeletePastOptions(opts)
-		for _, opt := range deletionOptions {
-			log.Print("Would delete options: ", opt)
-			// nextcloudClient.DeleteOption(&opt)
+	if defaultUsed {
+		errs = append(errs, c.Nextcloud.Validate("nextcloud"))
+	}
+	if c.Nextcloud.Name != "" {
+		errs = append(errs, errors.New("nextcloud.name is only used in nextcloud_accounts"))
+	}
+	names := map[string]bool{}
+	for i, account := range c.Accounts {
+		path := fmt.Sprintf("nextcloud_accounts[%d]", i)
+		if account.Name == "" {
+			errs = append(errs, fmt.Errorf("%s.name is not set", path))
+		} else if names[account.Name] {
+			errs = append(errs, fmt.Errorf("%s.name '%s' is used twice", path, account.Name))
 		}
-		newOptions := nextcloud.AddNewOptions(opts, 2)
-		for _, opt := range newOptions {
-			log.Print("New options: ", opt)
-			// nextcloudClient.CreateOption(&opt)
+		names[account.Name] = true
+		errs = append(errs, account.Validate(path))
+	}
+	for i, mapping := range c.Telegram.ChannelsToPolls {
+		if mapping.Account != nextcloud.DEFAULT_ACCOUNT && !names[mapping.Account] {
+			errs = append(errs, fmt.Errorf("telegram.channels[%d].nextcloud_account '%s' is not in nextcloud_accounts", i, mapping.Account))
 		}
-		// bot.Send(strings.Join(msgs, "\n"))
-	} else {
-		bot.Setup()
 	}
+	return errors.Join(errs...)
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: rpgreminder [-c config.json|config.yaml] <command> [arguments]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-13s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintln(out, "\nWithout a command the bot is started (serve). Use rpgreminder <command> -h for the arguments of a command.")
+}
+
+func main() {
+	configFile := flag.String("c", defaultConfigFile, "Configuration file for the bot")
+	flag.Usage = usage
+	flag.CommandLine.SetOutput(stderr)
+	log.SetOutput(stderr)
+	flag.Parse()
+	args := flag.Args()
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+	os.Exit(runCommand(name, *configFile, args))
 }
@@ -0,0 +1,117 @@
+// This file caches poll data so not every command needs a round trip.
+package nextcloud
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultCacheTTL time.Duration = time.Minute
+
+type cachedPoll struct {
+	options *PollOptions
+	loaded  time.Time
+}
+
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+// A TTL cache of loaded polls and the ETags of responses.
+//
+// All methods can be called on a nil cache, which caches nothing.
+type pollCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	polls     map[int]cachedPoll
+	responses map[string]cachedResponse
+}
+
+func cacheTTL(ttl int) time.Duration {
+	if ttl == 0 {
+		return defaultCacheTTL
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func newPollCache(ttl int) *pollCache {
+	return &pollCache{
+		ttl:       cacheTTL(ttl),
+		polls:     map[int]cachedPoll{},
+		responses: map[string]cachedResponse{},
+	}
+}
+
+// Drop everything that was cached and use the new TTL
+func (c *pollCache) reset(ttl int) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ttl = cacheTTL(ttl)
+	c.polls = map[int]cachedPoll{}
+	c.responses = map[string]cachedResponse{}
+}
+
+// Return a copy of the cached poll if it is not older than the TTL
+func (c *pollCache) poll(pollid int) (*PollOptions, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.polls[pollid]
+	if !ok || time.Since(cached.loaded) > c.ttl {
+		return nil, false
+	}
+	return &PollOptions{Options: slices.Clone(cached.options.Options)}, true
+}
+
+func (c *pollCache) storePoll(pollid int, options *PollOptions) {
+	if c == nil || c.ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.polls[pollid] = cachedPoll{
+		options: &PollOptions{Options: slices.Clone(options.Options)},
+		loaded:  time.Now(),
+	}
+}
+
+func (c *pollCache) response(url string) (cachedResponse, bool) {
+	if c == nil {
+		return cachedResponse{}, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.responses[url]
+	return cached, ok
+}
+
+func (c *pollCache) storeResponse(url string, etag string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.responses[url] = cachedResponse{etag: etag, body: body}
+}
+
+func (c *pollCache) invalidate(pollid int) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.polls, pollid)
+}
+
+// Drop the cached poll, so the next LoadPoll asks the server again. Responses
+// are still sent as conditional requests, as the server validates them.
+func (n *Nextcloud) Invalidate(pollid int) {
+	n.cache.invalidate(pollid)
+}
@@ -0,0 +1,45 @@
+package nextcloud
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPollCache(t *testing.T) {
+	requests := map[string]int{}
+	notModified := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if strings.HasSuffix(r.URL.Path, "/votes") {
+			w.Write([]byte(`{"votes": [{"optionId": 1, "answer": "yes", "user": {"userId": "anna"}}]}`))
+		} else {
+			w.Write([]byte(`{"options": [{"id": 1, "pollId": 1, "timestamp": 1763074800, "votes": {"yes": 1}}]}`))
+		}
+	}))
+	defer server.Close()
+	client := FromConfig(NextcloudConfig{Server: server.URL})
+
+	first, err := client.LoadPoll(1)
+	assert.NoError(t, err)
+	second, err := client.LoadPoll(1)
+	assert.NoError(t, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, 1, requests["/index.php/apps/polls/api/v1.0/poll/1/options"])
+
+	client.Invalidate(1)
+	third, err := client.LoadPoll(1)
+	assert.NoError(t, err)
+	assert.Equal(t, first, third)
+	assert.Equal(t, 2, requests["/index.php/apps/polls/api/v1.0/poll/1/options"])
+	assert.Equal(t, 2, notModified)
+}
@@ -0,0 +1,114 @@
+// This file obtains app passwords with the login flow of Nextcloud and checks
+// that they are still accepted.
+package nextcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Nextcloud discards a login flow that was not completed in this time
+const LoginFlowTimeout time.Duration = 20 * time.Minute
+
+// Returned by CheckCredentials if the server rejects the username or token
+var ErrRevoked = errors.New("the credentials were rejected, the app password may have been revoked")
+
+// A started Login Flow v2, see
+// https://docs.nextcloud.com/server/latest/developer_manual/client_apis/LoginFlow/index.html#login-flow-v2
+type LoginFlow struct {
+	// The page the user has to open to grant access
+	Login string `json:"login"`
+	Poll  struct {
+		Token    string `json:"token"`
+		Endpoint string `json:"endpoint"`
+	} `json:"poll"`
+	client *Nextcloud
+}
+
+// The credentials granted by the user
+type LoginResult struct {
+	Server      string `json:"server"`
+	LoginName   string `json:"loginName"`
+	AppPassword string `json:"appPassword"`
+}
+
+// Start a login flow on the server of the options - the username and token
+// are not used.
+func StartLogin(ctx context.Context, options NextcloudConfig) (*LoginFlow, error) {
+	options.Username, options.Token = "", ""
+	client := FromConfig(options)
+	url := fmt.Sprintf("%s/index.php/login/v2", options.Server)
+	status, body, err := client.RequestWithContext(ctx, url, "POST", nil)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, &StatusError{Code: status, Url: url}
+	}
+	var flow LoginFlow
+	err = json.Unmarshal(body, &flow)
+	if err != nil {
+		return nil, err
+	}
+	if flow.Login == "" || flow.Poll.Token == "" || flow.Poll.Endpoint == "" {
+		return nil, fmt.Errorf("%s did not start a login flow", options.Server)
+	}
+	flow.client = &client
+	return &flow, nil
+}
+
+// Wait until the user granted access, checking every interval. Fails once
+// the context is done.
+func (f *LoginFlow) Wait(ctx context.Context, interval time.Duration) (*LoginResult, error) {
+	form := []byte(url.Values{"token": {f.Poll.Token}}.Encode())
+	headers := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+	for {
+		status, _, body, err := f.client.request(ctx, f.Poll.Endpoint, "POST", form, headers)
+		if err != nil {
+			return nil, err
+		}
+		switch status {
+		case http.StatusOK:
+			var result LoginResult
+			err = json.Unmarshal(body, &result)
+			if err != nil {
+				return nil, err
+			}
+			if result.LoginName == "" || result.AppPassword == "" {
+				return nil, errors.New("the server did not return any credentials")
+			}
+			return &result, nil
+		case http.StatusNotFound:
+			// Access was not granted yet.
+		default:
+			return nil, &StatusError{Code: status, Url: f.Poll.Endpoint}
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Check that the server still accepts the username and token. ErrRevoked is
+// returned if it does not, other errors mean the server could not be asked.
+func (n *Nextcloud) CheckCredentials(ctx context.Context) error {
+	url := fmt.Sprintf("%s/ocs/v2.php/cloud/user?format=json", n.Options().Server)
+	status, _, _, err := n.request(ctx, url, "GET", nil, map[string]string{"OCS-APIRequest": "true"})
+	if err != nil {
+		return err
+	}
+	switch status {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrRevoked
+	}
+	return &StatusError{Code: status, Url: url}
+}
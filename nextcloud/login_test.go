@@ -0,0 +1,81 @@
+package nextcloud
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginFlow(t *testing.T) {
+	var polls atomic.Int32
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, authenticated := r.BasicAuth()
+		assert.False(t, authenticated)
+		assert.Equal(t, "POST", r.Method)
+		switch r.URL.Path {
+		case "/index.php/login/v2":
+			w.Write([]byte(`{"poll": {"token": "poll-token", "endpoint": "` + server.URL + `/login/v2/poll"}, "login": "` + server.URL + `/login/v2/flow/abc"}`))
+		case "/login/v2/poll":
+			assert.NoError(t, r.ParseForm())
+			assert.Equal(t, "poll-token", r.PostForm.Get("token"))
+			if polls.Add(1) < 3 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"server": "` + server.URL + `", "loginName": "rpgbot", "appPassword": "app-password"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	flow, err := StartLogin(context.Background(), NextcloudConfig{Server: server.URL, Username: "old", Token: "old"})
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/login/v2/flow/abc", flow.Login)
+	result, err := flow.Wait(context.Background(), time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, &LoginResult{Server: server.URL, LoginName: "rpgbot", AppPassword: "app-password"}, result)
+	assert.Equal(t, int32(3), polls.Load())
+
+	// The user never grants access
+	polls.Store(-1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = flow.Wait(ctx, time.Millisecond)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	_, err = StartLogin(context.Background(), NextcloudConfig{Server: server.URL + "/missing"})
+	assert.Error(t, err)
+}
+
+func TestCheckCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/ocs/v2.php/cloud/user", r.URL.Path)
+		assert.Equal(t, "true", r.Header.Get("OCS-APIRequest"))
+		_, token, _ := r.BasicAuth()
+		switch token {
+		case "valid":
+			w.Write([]byte(`{"ocs": {"data": {"id": "rpgbot"}}}`))
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	client := FromConfig(NextcloudConfig{Server: server.URL, Username: "rpgbot", Token: "valid"})
+	assert.NoError(t, client.CheckCredentials(context.Background()))
+	client.Reconfigure(NextcloudConfig{Server: server.URL, Username: "rpgbot", Token: "revoked"})
+	assert.ErrorIs(t, client.CheckCredentials(context.Background()), ErrRevoked)
+	client.Reconfigure(NextcloudConfig{Server: server.URL, Username: "rpgbot", Token: "broken"})
+	err := client.CheckCredentials(context.Background())
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrRevoked)
+}
@@ -2,19 +2,48 @@ package nextcloud
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"slices"
+	"sync/atomic"
 	"time"
 )
 
 type NextcloudConfig struct {
+	// Name chats use to refer to the account - only used in nextcloud_accounts
+	Name     string `json:"name,omitempty"`
 	Server   string `json:"server"`
 	Username string `json:"username"`
 	Token    string `json:"token"`
+	// Seconds a loaded poll is reused - 0 uses the default, negative disables it
+	CacheTTL int `json:"cache_ttl"`
+	// CA, proxy and timeouts of the connection to the server
+	HTTP HTTPConfig `json:"http"`
+}
+
+// Check that the configuration can be used to connect to Nextcloud. The path
+// names the account in the configuration file.
+func (c NextcloudConfig) Validate(path string) error {
+	errs := []error{}
+	if c.Server == "" {
+		errs = append(errs, fmt.Errorf("%s.server is not set", path))
+	} else if u, err := url.Parse(c.Server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("%s.server '%s' is not a URL like https://cloud.example.com", path, c.Server))
+	}
+	if c.Username == "" {
+		errs = append(errs, fmt.Errorf("%s.username is not set", path))
+	}
+	if c.Token == "" {
+		errs = append(errs, fmt.Errorf("%s.token is not set", path))
+	}
+	errs = append(errs, c.HTTP.validate(path))
+	return errors.Join(errs...)
 }
 
 type PollVote struct {
@@ -77,15 +106,33 @@ type PollOptions struct {
 }
 
 type Nextcloud struct {
-	Options NextcloudConfig
+	// Swapped when the configuration is reloaded while requests are running
+	http  *atomic.Pointer[httpClient]
+	cache *pollCache
 }
 
 func FromConfig(opts NextcloudConfig) Nextcloud {
-	return Nextcloud{Options: opts}
+	client := &atomic.Pointer[httpClient]{}
+	client.Store(newHTTPClient(opts))
+	return Nextcloud{http: client, cache: newPollCache(opts.CacheTTL)}
+}
+
+func (n *Nextcloud) Options() NextcloudConfig {
+	return n.http.Load().options
+}
+
+// Use the new configuration for all following requests. The cache is
+// dropped, as it may belong to another server or user.
+func (n *Nextcloud) Reconfigure(opts NextcloudConfig) {
+	if n.Options() == opts {
+		return
+	}
+	n.http.Store(newHTTPClient(opts))
+	n.cache.reset(opts.CacheTTL)
 }
 
 func (n *Nextcloud) Url(endpoint string, pollid int) string {
-	return fmt.Sprintf("%s/%s/%d/%s", n.Options.Server, "index.php/apps/polls/api/v1.0/poll", pollid, endpoint)
+	return fmt.Sprintf("%s/%s/%d/%s", n.Options().Server, "index.php/apps/polls/api/v1.0/poll", pollid, endpoint)
 }
 
 func (n *Nextcloud) VotesUrl(pollid int) string {
@@ -97,36 +144,99 @@ func (n *Nextcloud) PollsUrl(pollid int) string {
 }
 
 func (n *Nextcloud) Request(url string, requestType string, requestBody []byte) ([]byte, error) {
-	client := http.DefaultClient
-	r, err := http.NewRequest(requestType, url, bytes.NewBuffer([]byte(requestBody)))
+	_, body, err := n.RequestWithContext(context.Background(), url, requestType, requestBody)
+	return body, err
+}
+
+// Send a request that can be cancelled and also return the status code
+func (n *Nextcloud) RequestWithContext(ctx context.Context, url string, requestType string, requestBody []byte) (int, []byte, error) {
+	status, _, body, err := n.request(ctx, url, requestType, requestBody, nil)
+	return status, body, err
+}
+
+// Send the request - it is given up after the configured timeout unless the
+// context already has a deadline.
+func (n *Nextcloud) request(ctx context.Context, url string, requestType string, requestBody []byte, headers map[string]string) (int, http.Header, []byte, error) {
+	client := n.http.Load()
+	if client.err != nil {
+		return 0, nil, nil, client.err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.options.HTTP.timeout())
+		defer cancel()
+	}
+	r, err := http.NewRequestWithContext(ctx, requestType, url, bytes.NewBuffer([]byte(requestBody)))
 	if err != nil {
-		return nil, err
+		return 0, nil, nil, err
+	}
+	// The login flow is used before there are any credentials.
+	if client.options.Username != "" || client.options.Token != "" {
+		r.SetBasicAuth(client.options.Username, client.options.Token)
+	}
+	r.Header.Set("User-Agent", client.options.HTTP.userAgent())
+	r.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		r.Header.Set(key, value)
 	}
-	r.SetBasicAuth(n.Options.Username, n.Options.Token)
-	r.Header.Add("Content-Type", "application/json")
-	resp, err := client.Do(r)
+	resp, err := client.client.Do(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return resp.StatusCode, resp.Header, nil, err
 	}
 	log.Print("Retrieved URL: ", url, " with ", requestType, " - Status Code: ", resp.StatusCode)
-	return body, err
-
+	return resp.StatusCode, resp.Header, body, err
 }
 
+// Send a GET request - if the server sent an ETag for the URL before, the
+// request is conditional and the previous body is reused if it is unchanged.
 func (n *Nextcloud) Get(url string) ([]byte, error) {
-	return n.Request(url, "GET", nil)
+	headers := map[string]string{}
+	cached, ok := n.cache.response(url)
+	if ok {
+		headers["If-None-Match"] = cached.etag
+	}
+	status, header, body, err := n.request(context.Background(), url, "GET", nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotModified && ok {
+		return cached.body, nil
+	}
+	if status < 200 || status >= 300 {
+		return nil, &StatusError{Code: status, Url: url}
+	}
+	if etag := header.Get("ETag"); status == http.StatusOK && etag != "" {
+		n.cache.storeResponse(url, etag, body)
+	}
+	return body, nil
 }
 
-func (n *Nextcloud) Users(pollid int) ([]PollUser, error) {
+// Load all votes that were cast in the poll
+func (n *Nextcloud) Votes(pollid int) ([]PollVote, error) {
 	body, err := n.Get(n.VotesUrl(pollid))
+	if err != nil {
+		return nil, err
+	}
 	var votes PollVotes
 	err = json.Unmarshal(body, &votes)
 	if err != nil {
-		log.Fatal("Could not unmarshal nextcloud poll: ", err)
+		return nil, err
+	}
+	return votes.Options, nil
+}
+
+func (n *Nextcloud) Users(pollid int) ([]PollUser, error) {
+	votes, err := n.Votes(pollid)
+	if err != nil {
+		return nil, err
 	}
 	var users []PollUser
-	for _, vote := range votes.Options {
+	for _, vote := range votes {
 		if !slices.Contains(users, vote.User) {
 			users = append(users, vote.User)
 		}
@@ -134,28 +244,57 @@ func (n *Nextcloud) Users(pollid int) ([]PollUser, error) {
 	return users, nil
 }
 
+// An unexpected status code returned by the server
+type StatusError struct {
+	Code int
+	Url  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("request to %s failed with status code %d", e.Url, e.Code)
+}
+
+// Errors that will not go away by sending the same request again
+func (e *StatusError) Permanent() bool {
+	return e.Code >= 400 && e.Code < 500 && e.Code != http.StatusRequestTimeout && e.Code != http.StatusTooManyRequests
+}
+
+// Send a request that changes the poll and fail on any non-success status
+func (n *Nextcloud) mutate(url string, requestType string, requestBody []byte) error {
+	status, _, err := n.RequestWithContext(context.Background(), url, requestType, requestBody)
+	if err != nil {
+		return err
+	}
+	if status < 200 || status >= 300 {
+		return &StatusError{Code: status, Url: url}
+	}
+	return nil
+}
+
 func (n *Nextcloud) DeleteOption(o *PollOption) error {
 	log.Print("Removing poll option: ", o.Id)
-	url := fmt.Sprintf("%s/%s/%d", n.Options.Server, "index.php/apps/polls/api/v1.0/option/", o.Id)
-	_, err := n.Request(url, "DELETE", nil)
+	defer n.Invalidate(o.PollId)
+	url := fmt.Sprintf("%s/%s/%d", n.Options().Server, "index.php/apps/polls/api/v1.0/option", o.Id)
+	err := n.mutate(url, "DELETE", nil)
 	if err != nil {
-		log.Fatal("Failed to delete option: ", o.Id)
+		log.Print("Failed to delete option: ", o.Id, " - ", err)
 	}
 	return err
 }
 
 func (n *Nextcloud) CreateOption(pollid int, o *PollOptionCreate) error {
 	log.Print("Creating new option: ", o)
+	defer n.Invalidate(pollid)
 	byte, err := json.Marshal(o)
 	if err != nil {
-		log.Fatal("Could not marshal new option: ", err)
+		return err
 	}
 	url := n.Url("option", pollid)
-	_, err = n.Request(url, "POST", byte)
+	err = n.mutate(url, "POST", byte)
 	if err != nil {
-		log.Fatal("Failed to post new option: ", err)
+		log.Print("Failed to post new option: ", err)
 	}
-	return nil
+	return err
 }
 
 func (n *Nextcloud) DeleteOptions(options []PollOption) error {
@@ -168,40 +307,50 @@ func (n *Nextcloud) DeleteOptions(options []PollOption) error {
 	return nil
 }
 
+// Load the options of a poll - the result is cached until the TTL passed or
+// the poll was invalidated.
 func (n *Nextcloud) LoadPoll(pollid int) (*PollOptions, error) {
+	if options, ok := n.cache.poll(pollid); ok {
+		return options, nil
+	}
 	users, err := n.Users(pollid)
 	if err != nil {
-		log.Fatal("Failed to load users")
+		return nil, fmt.Errorf("failed to load users: %w", err)
 	}
 	body, err := n.Get(n.PollsUrl(pollid))
 	if err != nil {
-		log.Fatal("Failed to load options")
+		return nil, fmt.Errorf("failed to load options: %w", err)
 	}
 	var options PollOptions
 	err = json.Unmarshal(body, &options)
 	if err != nil {
-		log.Fatal("Could not unmarshal nextcloud poll: ", err)
+		return nil, fmt.Errorf("could not unmarshal nextcloud poll: %w", err)
 	}
 	for i, _ := range options.Options {
 		yes := options.Options[i].Votes.Yes
 		maybe := options.Options[i].Votes.Maybe
 		options.Options[i].Votes.No = len(users) - (yes + maybe)
 	}
+	n.cache.storePoll(pollid, &options)
 	return &options, nil
 }
 
 // Return the dates of the next weekend only
 func NextWeekend(options *PollOptions) []PollOption {
-	var nextWeekend []PollOption
 	today := time.Now()
+	return OptionsBetween(options, today, today.Add(24*7*time.Hour))
+}
+
+// Return all options that start after from and before to
+func OptionsBetween(options *PollOptions, from time.Time, to time.Time) []PollOption {
+	var between []PollOption
 	for _, opt := range options.Options {
 		date := opt.Datetime()
-		diff := date.Sub(today)
-		if diff.Hours() > 0 && diff.Hours() < 24*7 {
-			nextWeekend = append(nextWeekend, opt)
+		if date.After(from) && date.Before(to) {
+			between = append(between, opt)
 		}
 	}
-	return nextWeekend
+	return between
 }
 
 // Create new vote options for Friday and Saturdays starting from the last
@@ -264,10 +413,14 @@ func AddNewOptions(pollOptions *PollOptions, i int) []PollOptionCreate {
 
 // This function just returns the options that would be deleted
 func DeletePastOptions(o *PollOptions) []PollOption {
+	return DeleteOptionsBefore(o, time.Now())
+}
+
+// Returns the options that start before the given date
+func DeleteOptionsBefore(o *PollOptions, before time.Time) []PollOption {
 	remove := []PollOption{}
-	now := time.Now()
 	for _, option := range o.Options {
-		if option.Datetime().Before(now) {
+		if option.Datetime().Before(before) {
 			remove = append(remove, option)
 		}
 	}
@@ -0,0 +1,54 @@
+package nextcloud
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadPollFailedRequest(t *testing.T) {
+	for _, code := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		failing := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failing {
+				w.WriteHeader(code)
+				w.Write([]byte(`{"message": "failed"}`))
+				return
+			}
+			if strings.HasSuffix(r.URL.Path, "/votes") {
+				w.Write([]byte(`{"votes": [{"optionId": 1, "answer": "yes", "user": {"userId": "anna"}}]}`))
+			} else {
+				w.Write([]byte(`{"options": [{"id": 1, "pollId": 1, "timestamp": 1763074800, "votes": {"yes": 1}}]}`))
+			}
+		}))
+		client := FromConfig(NextcloudConfig{Server: server.URL})
+
+		options, err := client.LoadPoll(1)
+		assert.NoError(t, err)
+		votes, err := client.Votes(1)
+		assert.NoError(t, err)
+		before := TakeSnapshot(options, votes)
+
+		failing = true
+		client.Invalidate(1)
+		_, err = client.LoadPoll(1)
+		var statusErr *StatusError
+		assert.True(t, errors.As(err, &statusErr))
+		assert.Equal(t, code, statusErr.Code)
+		_, err = client.Votes(1)
+		assert.Error(t, err)
+
+		// The failure did not leave an empty poll behind
+		failing = false
+		options, err = client.LoadPoll(1)
+		assert.NoError(t, err)
+		votes, err = client.Votes(1)
+		assert.NoError(t, err)
+		assert.Empty(t, DiffSnapshots(before, TakeSnapshot(options, votes), 0))
+		server.Close()
+	}
+}
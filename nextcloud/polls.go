@@ -0,0 +1,143 @@
+// This file creates polls and changes their settings.
+package nextcloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Who can find and vote in a poll
+type PollAccess = string
+
+const (
+	// Only invited users and users with a share link
+	ACCESS_PRIVATE PollAccess = "private"
+	// All users of the Nextcloud server
+	ACCESS_OPEN PollAccess = "open"
+)
+
+const DATE_POLL string = "datePoll"
+
+type Poll struct {
+	Id        int    `json:"id"`
+	Title     string `json:"title"`
+	Type      string `json:"type"`
+	Access    string `json:"access"`
+	Anonymous int    `json:"anonymous"`
+	// When the poll stops accepting votes - 0 if it does not
+	Expire int64 `json:"expire"`
+	// When the poll was archived - 0 if it was not
+	Deleted int64 `json:"deleted"`
+}
+
+type pollResponse struct {
+	Poll Poll `json:"poll"`
+}
+
+// Changes to the settings of a poll - only the fields that are set are sent
+type PollUpdate struct {
+	Access    PollAccess `json:"access,omitempty"`
+	Anonymous int        `json:"anonymous,omitempty"`
+	Expire    int64      `json:"expire,omitempty"`
+}
+
+type shareResponse struct {
+	Share struct {
+		Token string `json:"token"`
+	} `json:"share"`
+}
+
+func (n *Nextcloud) pollUrl(pollid int) string {
+	return fmt.Sprintf("%s/%s/%d", n.Options().Server, "index.php/apps/polls/api/v1.0/poll", pollid)
+}
+
+// Send a request to the Polls app and decode the response into result
+func (n *Nextcloud) pollRequest(url string, requestType string, requestBody any, result any) error {
+	var body []byte
+	if requestBody != nil {
+		var err error
+		body, err = json.Marshal(requestBody)
+		if err != nil {
+			return err
+		}
+	}
+	status, response, err := n.RequestWithContext(context.Background(), url, requestType, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK && status != http.StatusCreated {
+		return &StatusError{Code: status, Url: url}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(response, result)
+}
+
+// Create an empty date poll
+func (n *Nextcloud) CreatePoll(title string) (*Poll, error) {
+	log.Print("Creating poll: ", title)
+	url := fmt.Sprintf("%s/%s", n.Options().Server, "index.php/apps/polls/api/v1.0/poll")
+	var response pollResponse
+	err := n.pollRequest(url, "POST", map[string]string{"title": title, "type": DATE_POLL}, &response)
+	if err != nil {
+		return nil, err
+	}
+	if response.Poll.Id == 0 {
+		return nil, errors.New("the server did not return the created poll")
+	}
+	return &response.Poll, nil
+}
+
+// Load the settings of the poll
+func (n *Nextcloud) LoadPollSettings(pollid int) (*Poll, error) {
+	var response pollResponse
+	err := n.pollRequest(n.pollUrl(pollid), "GET", nil, &response)
+	if err != nil {
+		return nil, err
+	}
+	return &response.Poll, nil
+}
+
+func (n *Nextcloud) UpdatePoll(pollid int, update PollUpdate) error {
+	log.Print("Updating poll ", pollid, ": ", update)
+	return n.pollRequest(n.pollUrl(pollid), "PUT", map[string]PollUpdate{"poll": update}, nil)
+}
+
+// Stop accepting votes - the poll and its votes stay visible
+func (n *Nextcloud) ClosePoll(pollid int, now time.Time) error {
+	return n.UpdatePoll(pollid, PollUpdate{Expire: now.Unix()})
+}
+
+// Move the poll to the archive of its owner. Archiving an archived poll does
+// nothing.
+func (n *Nextcloud) ArchivePoll(pollid int) error {
+	poll, err := n.LoadPollSettings(pollid)
+	if err != nil {
+		return err
+	}
+	if poll.Deleted != 0 {
+		return nil
+	}
+	log.Print("Archiving poll ", pollid)
+	return n.pollRequest(n.pollUrl(pollid)+"/toggleArchive", "PUT", nil, nil)
+}
+
+// Create a public share of the poll and return its link, so people without
+// an account on the server can vote.
+func (n *Nextcloud) SharePoll(pollid int) (string, error) {
+	var response shareResponse
+	err := n.pollRequest(n.pollUrl(pollid)+"/share/public", "POST", nil, &response)
+	if err != nil {
+		return "", err
+	}
+	if response.Share.Token == "" {
+		return "", fmt.Errorf("the server did not return a share of poll %d", pollid)
+	}
+	return fmt.Sprintf("%s/index.php/apps/polls/s/%s", n.Options().Server, response.Share.Token), nil
+}
@@ -0,0 +1,62 @@
+package nextcloud
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManagePoll(t *testing.T) {
+	requests := []string{}
+	archived := int64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		switch r.Method + " " + r.URL.Path {
+		case "POST /index.php/apps/polls/api/v1.0/poll":
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"poll": {"id": 12, "title": "Season 3", "type": "datePoll"}}`))
+		case "GET /index.php/apps/polls/api/v1.0/poll/12":
+			json.NewEncoder(w).Encode(map[string]Poll{"poll": {Id: 12, Deleted: archived}})
+		case "PUT /index.php/apps/polls/api/v1.0/poll/12/toggleArchive":
+			archived = 1763074800
+		case "POST /index.php/apps/polls/api/v1.0/poll/12/share/public":
+			w.Write([]byte(`{"share": {"token": "aBc123"}}`))
+		case "PUT /index.php/apps/polls/api/v1.0/poll/12":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client := FromConfig(NextcloudConfig{Server: server.URL, Username: "bot", Token: "token"})
+
+	poll, err := client.CreatePoll("Season 3")
+	assert.NoError(t, err)
+	assert.Equal(t, 12, poll.Id)
+	assert.NoError(t, client.UpdatePoll(12, PollUpdate{Access: ACCESS_OPEN, Anonymous: 1}))
+	link, err := client.SharePoll(12)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/index.php/apps/polls/s/aBc123", link)
+	assert.NoError(t, client.ClosePoll(12, time.Unix(1763074800, 0)))
+	assert.NoError(t, client.ArchivePoll(12))
+	// Already archived, so it is not toggled back
+	assert.NoError(t, client.ArchivePoll(12))
+	var status *StatusError
+	assert.ErrorAs(t, client.ArchivePoll(13), &status)
+
+	assert.Equal(t, []string{
+		`POST /index.php/apps/polls/api/v1.0/poll {"title":"Season 3","type":"datePoll"}`,
+		`PUT /index.php/apps/polls/api/v1.0/poll/12 {"poll":{"access":"open","anonymous":1}}`,
+		`POST /index.php/apps/polls/api/v1.0/poll/12/share/public `,
+		`PUT /index.php/apps/polls/api/v1.0/poll/12 {"poll":{"expire":1763074800}}`,
+		`GET /index.php/apps/polls/api/v1.0/poll/12 `,
+		`PUT /index.php/apps/polls/api/v1.0/poll/12/toggleArchive `,
+		`GET /index.php/apps/polls/api/v1.0/poll/12 `,
+		`GET /index.php/apps/polls/api/v1.0/poll/13 `,
+	}, requests)
+}
@@ -0,0 +1,99 @@
+// This file keeps one client per configured Nextcloud account.
+package nextcloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// The account of the "nextcloud" section, used by chats without an account
+const DEFAULT_ACCOUNT string = ""
+
+// One client per account, so every account has its own credentials and cache
+type Pool struct {
+	lock    sync.RWMutex
+	clients map[string]*Nextcloud
+}
+
+func NewPool(accounts []NextcloudConfig) *Pool {
+	pool := &Pool{clients: map[string]*Nextcloud{}}
+	pool.Reconfigure(accounts)
+	return pool
+}
+
+// The client of the account with the name
+func (p *Pool) Client(account string) (*Nextcloud, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	client, ok := p.clients[account]
+	if !ok && account == DEFAULT_ACCOUNT {
+		return nil, errors.New("the nextcloud section is not configured")
+	}
+	if !ok {
+		return nil, fmt.Errorf("nextcloud account '%s' is not configured", account)
+	}
+	return client, nil
+}
+
+// Use the new accounts. Clients of accounts that are still configured are
+// kept, so they keep their cache if the account did not change.
+func (p *Pool) Reconfigure(accounts []NextcloudConfig) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	clients := map[string]*Nextcloud{}
+	for _, account := range accounts {
+		client, ok := p.clients[account.Name]
+		if ok {
+			client.Reconfigure(account)
+		} else {
+			created := FromConfig(account)
+			client = &created
+		}
+		clients[account.Name] = client
+	}
+	p.clients = clients
+}
+
+// Watch the polls of every account, given by account name. The events of
+// all accounts are sent to the returned channel, which is closed once the
+// context is cancelled.
+func (p *Pool) Watch(ctx context.Context, polls map[string][]int) <-chan PollEvent {
+	events := make(chan PollEvent)
+	var running sync.WaitGroup
+	for account, pollids := range polls {
+		client, err := p.Client(account)
+		if err != nil {
+			log.Print("Not watching polls ", pollids, ": ", err)
+			continue
+		}
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for event := range client.Watch(ctx, pollids) {
+				event.Account = account
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		running.Wait()
+		close(events)
+	}()
+	return events
+}
+
+// The names of all configured accounts
+func (p *Pool) Accounts() []string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return slices.Sorted(maps.Keys(p.clients))
+}
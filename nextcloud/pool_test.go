@@ -0,0 +1,25 @@
+package nextcloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	pool := NewPool([]NextcloudConfig{{Server: "https://one.example.com"}, {Name: "club", Server: "https://two.example.com"}})
+	club, err := pool.Client("club")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://two.example.com", club.Options().Server)
+	_, err = pool.Client("unknown")
+	assert.EqualError(t, err, "nextcloud account 'unknown' is not configured")
+
+	pool.Reconfigure([]NextcloudConfig{{Name: "club", Server: "https://three.example.com"}})
+	reloaded, err := pool.Client("club")
+	assert.NoError(t, err)
+	// Clients of accounts that are still configured are kept
+	assert.Same(t, club, reloaded)
+	assert.Equal(t, "https://three.example.com", club.Options().Server)
+	_, err = pool.Client(DEFAULT_ACCOUNT)
+	assert.EqualError(t, err, "the nextcloud section is not configured")
+}
@@ -0,0 +1,126 @@
+// This file compares the state of a poll at two points in time.
+package nextcloud
+
+import (
+	"maps"
+	"slices"
+)
+
+type ChangeType = string
+
+const VOTE_CHANGED ChangeType = "vote"
+const QUORUM_REACHED ChangeType = "quorum"
+const QUORUM_LOST ChangeType = "quorum_lost"
+const OPTION_ADDED ChangeType = "added"
+const OPTION_REMOVED ChangeType = "removed"
+
+// The answers of all users for a single option
+type OptionSnapshot struct {
+	Timestamp int64 `json:"timestamp"`
+	// Answer by the display name of the user
+	Answers map[string]string `json:"answers"`
+}
+
+func (o *OptionSnapshot) Yes() int {
+	yes := 0
+	for _, answer := range o.Answers {
+		if answer == "yes" {
+			yes++
+		}
+	}
+	return yes
+}
+
+// The state of a poll by option ID
+type Snapshot struct {
+	Options map[int]OptionSnapshot `json:"options"`
+}
+
+// A single difference between two snapshots
+type Change struct {
+	Type      ChangeType
+	Timestamp int64
+	User      string
+	Answer    string
+}
+
+func userName(u PollUser) string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.UserId
+}
+
+// Build a snapshot from the options and the votes of a poll
+func TakeSnapshot(options *PollOptions, votes []PollVote) Snapshot {
+	snapshot := Snapshot{Options: map[int]OptionSnapshot{}}
+	for _, opt := range options.Options {
+		if opt.Deleted != 0 {
+			continue
+		}
+		snapshot.Options[opt.Id] = OptionSnapshot{Timestamp: opt.Timestamp, Answers: map[string]string{}}
+	}
+	for _, vote := range votes {
+		opt, ok := snapshot.Options[vote.OptionId]
+		if !ok || vote.Deleted != 0 {
+			continue
+		}
+		opt.Answers[userName(vote.User)] = vote.Answer
+	}
+	return snapshot
+}
+
+func (s Snapshot) Equal(other Snapshot) bool {
+	return maps.EqualFunc(s.Options, other.Options, func(a OptionSnapshot, b OptionSnapshot) bool {
+		return a.Timestamp == b.Timestamp && maps.Equal(a.Answers, b.Answers)
+	})
+}
+
+// Return all changes between the old and the new snapshot ordered by the date
+// of the option. An option has quorum once it has at least quorum yes votes,
+// a quorum of 0 disables the quorum changes.
+func DiffSnapshots(old Snapshot, new Snapshot, quorum int) []Change {
+	changes := []Change{}
+	ids := slices.Collect(maps.Keys(new.Options))
+	slices.SortFunc(ids, func(a int, b int) int {
+		return int(new.Options[a].Timestamp - new.Options[b].Timestamp)
+	})
+	for _, id := range ids {
+		opt := new.Options[id]
+		before, existed := old.Options[id]
+		if !existed {
+			changes = append(changes, Change{Type: OPTION_ADDED, Timestamp: opt.Timestamp})
+			continue
+		}
+		// Users that withdrew their vote are only in the old snapshot.
+		users := slices.Sorted(maps.Keys(opt.Answers))
+		for user := range before.Answers {
+			if _, ok := opt.Answers[user]; !ok {
+				users = append(users, user)
+			}
+		}
+		slices.Sort(users)
+		for _, user := range users {
+			if before.Answers[user] != opt.Answers[user] {
+				changes = append(changes, Change{Type: VOTE_CHANGED, Timestamp: opt.Timestamp, User: user, Answer: opt.Answers[user]})
+			}
+		}
+		if quorum > 0 {
+			if before.Yes() < quorum && opt.Yes() >= quorum {
+				changes = append(changes, Change{Type: QUORUM_REACHED, Timestamp: opt.Timestamp})
+			} else if before.Yes() >= quorum && opt.Yes() < quorum {
+				changes = append(changes, Change{Type: QUORUM_LOST, Timestamp: opt.Timestamp})
+			}
+		}
+	}
+	removed := []Change{}
+	for id, opt := range old.Options {
+		if _, ok := new.Options[id]; !ok {
+			removed = append(removed, Change{Type: OPTION_REMOVED, Timestamp: opt.Timestamp})
+		}
+	}
+	slices.SortFunc(removed, func(a Change, b Change) int {
+		return int(a.Timestamp - b.Timestamp)
+	})
+	return append(changes, removed...)
+}
@@ -0,0 +1,59 @@
+package nextcloud
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	options := &PollOptions{Options: []PollOption{
+		{Id: 1, Timestamp: 1763074800},
+		{Id: 2, Timestamp: 1763161200},
+	}}
+	anna := PollUser{UserId: "anna", DisplayName: "Anna"}
+	ben := PollUser{UserId: "ben"}
+	old := TakeSnapshot(options, []PollVote{
+		{OptionId: 1, Answer: "yes", User: ben},
+		{OptionId: 2, Answer: "no", User: anna},
+	})
+	new := TakeSnapshot(options, []PollVote{
+		{OptionId: 1, Answer: "yes", User: ben},
+		{OptionId: 1, Answer: "yes", User: anna},
+		{OptionId: 2, Answer: "yes", User: anna},
+	})
+
+	assert.False(t, old.Equal(new))
+	assert.Equal(t, []Change{
+		{Type: VOTE_CHANGED, Timestamp: 1763074800, User: "Anna", Answer: "yes"},
+		{Type: QUORUM_REACHED, Timestamp: 1763074800},
+		{Type: VOTE_CHANGED, Timestamp: 1763161200, User: "Anna", Answer: "yes"},
+	}, DiffSnapshots(old, new, 2))
+	assert.Empty(t, DiffSnapshots(new, new, 2))
+}
+
+func TestDiffSnapshotsOptions(t *testing.T) {
+	old := TakeSnapshot(&PollOptions{Options: []PollOption{{Id: 1, Timestamp: 100}}}, nil)
+	new := TakeSnapshot(&PollOptions{Options: []PollOption{{Id: 2, Timestamp: 200}}}, nil)
+
+	assert.Equal(t, []Change{
+		{Type: OPTION_ADDED, Timestamp: 200},
+		{Type: OPTION_REMOVED, Timestamp: 100},
+	}, DiffSnapshots(old, new, 0))
+}
+
+func TestDiffSnapshotsWithdrawnVote(t *testing.T) {
+	options := &PollOptions{Options: []PollOption{{Id: 1, Timestamp: 1763074800}}}
+	anna := PollUser{UserId: "anna", DisplayName: "Anna"}
+	ben := PollUser{UserId: "ben"}
+	old := TakeSnapshot(options, []PollVote{
+		{OptionId: 1, Answer: "yes", User: anna},
+		{OptionId: 1, Answer: "yes", User: ben},
+	})
+	new := TakeSnapshot(options, []PollVote{{OptionId: 1, Answer: "yes", User: ben}})
+
+	assert.Equal(t, []Change{
+		{Type: VOTE_CHANGED, Timestamp: 1763074800, User: "Anna", Answer: ""},
+		{Type: QUORUM_LOST, Timestamp: 1763074800},
+	}, DiffSnapshots(old, new, 2))
+}
@@ -0,0 +1,218 @@
+// This file builds the HTTP client of an account and logs its requests.
+package nextcloud
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Used if no timeout is configured - the watch endpoint has its own
+const defaultTimeout time.Duration = 30 * time.Second
+
+const defaultUserAgent string = "rpgreminder"
+
+// Logged response bodies are cut off after this many bytes
+const maxLoggedBody int = 2048
+
+type HTTPConfig struct {
+	// PEM file with certificate authorities trusted in addition to the
+	// system ones, e.g. a private CA
+	CAFile string `json:"ca_file"`
+	// Client certificate and key in PEM format for mutual TLS
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Proxy for all requests, e.g. http://proxy:3128 - empty uses the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables
+	Proxy string `json:"proxy"`
+	// Seconds until a request is given up - 0 uses 30 seconds
+	Timeout int `json:"timeout"`
+	// Seconds until connecting and the TLS handshake are given up - 0 uses
+	// the Go defaults
+	ConnectTimeout int    `json:"connect_timeout"`
+	UserAgent      string `json:"user_agent"`
+	// Accept any certificate - only for test setups
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// Log every request and response, credentials are redacted
+	Debug bool `json:"debug"`
+}
+
+// The proxy with its password masked, so it can be printed
+func (c HTTPConfig) RedactedProxy() string {
+	proxy, err := url.Parse(c.Proxy)
+	if err == nil && proxy.User != nil {
+		return proxy.Redacted()
+	}
+	// Without a URL it is unclear where the password ends.
+	if i := strings.LastIndex(c.Proxy, "@"); i >= 0 {
+		return "xxxxx" + c.Proxy[i:]
+	}
+	return c.Proxy
+}
+
+// The password in the proxy URL, if it has one
+func (c HTTPConfig) ProxyPassword() string {
+	proxy, err := url.Parse(c.Proxy)
+	if err != nil || proxy.User == nil {
+		return ""
+	}
+	password, _ := proxy.User.Password()
+	return password
+}
+
+func (c HTTPConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultTimeout
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c HTTPConfig) userAgent() string {
+	if c.UserAgent == "" {
+		return defaultUserAgent
+	}
+	return c.UserAgent
+}
+
+func (c HTTPConfig) validate(path string) error {
+	errs := []error{}
+	if c.Timeout < 0 || c.ConnectTimeout < 0 {
+		errs = append(errs, fmt.Errorf("%s.http: timeout and connect_timeout must not be negative", path))
+	}
+	if _, err := c.transport(); err != nil {
+		errs = append(errs, fmt.Errorf("%s.http: %w", path, err))
+	}
+	return errors.Join(errs...)
+}
+
+// Build the transport for the settings. Fails if the files can not be read.
+func (c HTTPConfig) transport() (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s does not contain any PEM certificate", c.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil || proxy.Scheme == "" || proxy.Host == "" {
+			return nil, fmt.Errorf("proxy '%s' is not a URL like http://proxy:3128", c.RedactedProxy())
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	if c.ConnectTimeout > 0 {
+		timeout := time.Duration(c.ConnectTimeout) * time.Second
+		transport.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+	}
+	return transport, nil
+}
+
+// The HTTP client of an account - err is set instead if the settings could
+// not be used and returned by every request.
+type httpClient struct {
+	options NextcloudConfig
+	client  *http.Client
+	err     error
+}
+
+func newHTTPClient(options NextcloudConfig) *httpClient {
+	transport, err := options.HTTP.transport()
+	if err != nil {
+		return &httpClient{options: options, err: fmt.Errorf("invalid http settings for %s: %w", options.Server, err)}
+	}
+	if options.HTTP.InsecureSkipVerify {
+		log.Print("Certificates of ", options.Server, " are not verified")
+	}
+	var roundTripper http.RoundTripper = transport
+	if options.HTTP.Debug {
+		roundTripper = &debugTransport{next: transport, secrets: []string{options.Token}}
+	}
+	return &httpClient{options: options, client: &http.Client{Transport: roundTripper}}
+}
+
+// Values of these JSON fields are removed from logged bodies
+var secretFields = regexp.MustCompile(`("(?:token|password|appPassword)"\s*:\s*)"[^"]*"`)
+
+var secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie"}
+
+// Logs every request and response without credentials
+type debugTransport struct {
+	next    http.RoundTripper
+	secrets []string
+}
+
+func (d *debugTransport) redact(text string) string {
+	for _, secret := range d.secrets {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, "[REDACTED]")
+		}
+	}
+	return secretFields.ReplaceAllString(text, `$1"[REDACTED]"`)
+}
+
+func (d *debugTransport) headers(header http.Header) string {
+	lines := []string{}
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		value := strings.Join(header.Values(name), ", ")
+		if slices.Contains(secretHeaders, name) {
+			value = "[REDACTED]"
+		}
+		lines = append(lines, name+": "+value)
+	}
+	return d.redact(strings.Join(lines, "; "))
+}
+
+func (d *debugTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	target := d.redact(r.Method + " " + r.URL.Redacted())
+	log.Print("Nextcloud request ", target, " - ", d.headers(r.Header))
+	resp, err := d.next.RoundTrip(r)
+	if err != nil {
+		log.Print("Nextcloud request ", target, " failed after ", time.Since(start), ": ", d.redact(err.Error()))
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	logged := string(body)
+	if len(body) > maxLoggedBody {
+		logged = string(body[:maxLoggedBody]) + "..."
+	}
+	log.Print("Nextcloud response ", target, " ", resp.Status, " after ", time.Since(start), " - ", d.headers(resp.Header), " - ", d.redact(logged))
+	return resp, nil
+}
@@ -0,0 +1,106 @@
+package nextcloud
+
+import (
+	"bytes"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCAFile(t *testing.T) {
+	userAgent := ""
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := FromConfig(NextcloudConfig{Server: server.URL})
+	_, err := client.Get(server.URL)
+	assert.ErrorContains(t, err, "certificate")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600)
+	assert.NoError(t, err)
+	client.Reconfigure(NextcloudConfig{Server: server.URL, HTTP: HTTPConfig{CAFile: caFile}})
+	_, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultUserAgent, userAgent)
+
+	client.Reconfigure(NextcloudConfig{Server: server.URL, HTTP: HTTPConfig{InsecureSkipVerify: true, UserAgent: "club-bot"}})
+	_, err = client.Get(server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "club-bot", userAgent)
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	client := FromConfig(NextcloudConfig{Server: server.URL, HTTP: HTTPConfig{Timeout: 1}})
+	start := time.Now()
+	_, err := client.Get(server.URL)
+	assert.ErrorContains(t, err, "deadline exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestValidateHTTP(t *testing.T) {
+	config := NextcloudConfig{Server: "https://cloud.example.com", Username: "bot", Token: "token"}
+	assert.NoError(t, config.Validate("nextcloud"))
+
+	config.HTTP = HTTPConfig{Proxy: "proxy:3128", CAFile: "/does/not/exist.pem", Timeout: -1}
+	err := config.Validate("nextcloud")
+	assert.ErrorContains(t, err, "nextcloud.http: timeout and connect_timeout must not be negative")
+	assert.ErrorContains(t, err, "/does/not/exist.pem")
+
+	config.HTTP = HTTPConfig{Proxy: "proxy:3128"}
+	assert.EqualError(t, config.Validate("nextcloud"), "nextcloud.http: proxy 'proxy:3128' is not a URL like http://proxy:3128")
+	// The password of the proxy is not shown
+	config.HTTP = HTTPConfig{Proxy: "bot:proxy-secret@proxy:3128"}
+	assert.EqualError(t, config.Validate("nextcloud"), "nextcloud.http: proxy 'xxxxx@proxy:3128' is not a URL like http://proxy:3128")
+	config.HTTP = HTTPConfig{Proxy: "http://bot:proxy-secret@"}
+	assert.EqualError(t, config.Validate("nextcloud"), "nextcloud.http: proxy 'http://bot:xxxxx@' is not a URL like http://proxy:3128")
+	config.HTTP = HTTPConfig{Proxy: "proxy:3128"}
+
+	// Requests fail with the error instead of ignoring the settings
+	client := FromConfig(config)
+	_, err = client.Get("https://cloud.example.com")
+	assert.ErrorContains(t, err, "invalid http settings for https://cloud.example.com")
+}
+
+func TestDebugLogRedactsCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Write([]byte(`{"appPassword": "generated", "loginName": "bot", "echo": "supersecret"}`))
+	}))
+	defer server.Close()
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	client := FromConfig(NextcloudConfig{Server: server.URL, Username: "bot", Token: "supersecret", HTTP: HTTPConfig{Debug: true}})
+	body, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	// Only the log is redacted
+	assert.Contains(t, string(body), "generated")
+
+	assert.Contains(t, logged.String(), "Nextcloud request GET "+server.URL)
+	assert.Contains(t, logged.String(), "200 OK")
+	assert.Contains(t, logged.String(), "Authorization: [REDACTED]")
+	assert.Contains(t, logged.String(), "Set-Cookie: [REDACTED]")
+	assert.Contains(t, logged.String(), `"loginName": "bot"`)
+	assert.NotContains(t, logged.String(), "supersecret")
+	assert.NotContains(t, logged.String(), "generated")
+	assert.NotContains(t, logged.String(), "abc")
+}
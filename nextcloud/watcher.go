@@ -0,0 +1,133 @@
+// This file subscribes to the long-poll watch endpoint of the Polls app.
+package nextcloud
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Variables, so the tests do not have to wait
+var minBackoff time.Duration = time.Second
+var maxBackoff time.Duration = 5 * time.Minute
+
+// A server that answers right away instead of holding the request open is
+// asked again after this time at the earliest
+var minWatchInterval time.Duration = time.Second
+
+// A watch request is given up if the server did not answer in this time
+const watchTimeout time.Duration = 10 * time.Minute
+
+// A change in a poll reported by the watch endpoint
+type PollEvent struct {
+	// The account of the poll - only set by Pool.Watch
+	Account string
+	PollId  int
+	// The part of the poll that changed, e.g. "votes", "options" or "poll"
+	Table   string
+	Updated time.Time
+}
+
+type watchUpdate struct {
+	Id      int    `json:"id"`
+	PollId  int    `json:"pollId"`
+	Table   string `json:"table"`
+	Updated int64  `json:"updated"`
+}
+
+type watchResponse struct {
+	Updates []watchUpdate `json:"updates"`
+}
+
+func (n *Nextcloud) WatchUrl(pollid int, offset int64) string {
+	return fmt.Sprintf("%s/%s/%d/watch?offset=%d", n.Options().Server, "index.php/apps/polls/poll", pollid, offset)
+}
+
+// Subscribe to the watch endpoint of all given polls.
+//
+// The server holds each request open until the poll changes or a timeout
+// passes. Failed requests are retried with an exponential backoff until the
+// context is cancelled, at which point the returned channel is closed.
+func (n *Nextcloud) Watch(ctx context.Context, pollids []int) <-chan PollEvent {
+	events := make(chan PollEvent)
+	done := make(chan struct{})
+	for _, pollid := range pollids {
+		go func() {
+			n.watchPoll(ctx, pollid, events)
+			done <- struct{}{}
+		}()
+	}
+	go func() {
+		for range pollids {
+			<-done
+		}
+		close(events)
+	}()
+	return events
+}
+
+func (n *Nextcloud) watchPoll(ctx context.Context, pollid int, events chan<- PollEvent) {
+	offset := time.Now().Unix()
+	backoff := minBackoff
+	for ctx.Err() == nil {
+		start := time.Now()
+		updates, err := n.watchOnce(ctx, pollid, offset)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Print("Watching poll ", pollid, " failed - retrying in ", backoff, ": ", err)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		if len(updates) == 0 {
+			select {
+			case <-time.After(minWatchInterval - time.Since(start)):
+			case <-ctx.Done():
+				return
+			}
+		}
+		for _, update := range updates {
+			offset = max(offset, update.Updated)
+			select {
+			case events <- PollEvent{PollId: pollid, Table: update.Table, Updated: time.Unix(update.Updated, 0)}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Wait for a single batch of updates - no updates are returned if the server
+// timed out without a change.
+func (n *Nextcloud) watchOnce(ctx context.Context, pollid int, offset int64) ([]watchUpdate, error) {
+	// The server holds the request open, so the timeout of other requests
+	// does not apply.
+	ctx, cancel := context.WithTimeout(ctx, watchTimeout)
+	defer cancel()
+	status, body, err := n.RequestWithContext(ctx, n.WatchUrl(pollid, offset), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	switch status {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+		var response watchResponse
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			return nil, err
+		}
+		return response.Updates, nil
+	}
+	return nil, fmt.Errorf("unexpected status code %d", status)
+}
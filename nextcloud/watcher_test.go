@@ -0,0 +1,65 @@
+package nextcloud
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchReconnects(t *testing.T) {
+	minBackoff, maxBackoff, minWatchInterval = 20*time.Millisecond, 40*time.Millisecond, 50*time.Millisecond
+	defer func() {
+		minBackoff, maxBackoff, minWatchInterval = time.Second, 5*time.Minute, time.Second
+	}()
+	var lock sync.Mutex
+	requests := []time.Time{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests = append(requests, time.Now())
+		count := len(requests)
+		lock.Unlock()
+		switch {
+		case count <= 3:
+			w.WriteHeader(http.StatusInternalServerError)
+		case count <= 5:
+			// Answers right away without holding the request open
+			w.Write([]byte(`{"updates": []}`))
+		default:
+			w.Write([]byte(`{"updates": [{"id": 1, "pollId": 4, "table": "votes", "updated": 1763074800}]}`))
+		}
+	}))
+	defer server.Close()
+	client := FromConfig(NextcloudConfig{Server: server.URL})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := client.Watch(ctx, []int{4})
+	select {
+	case event := <-events:
+		assert.Equal(t, PollEvent{PollId: 4, Table: "votes", Updated: time.Unix(1763074800, 0)}, event)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event after the server recovered")
+	}
+	cancel()
+	for range events {
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	gaps := []time.Duration{}
+	for i := 1; i < 6; i++ {
+		gaps = append(gaps, requests[i].Sub(requests[i-1]))
+	}
+	// Failures back off exponentially up to the maximum
+	assert.GreaterOrEqual(t, gaps[0], 20*time.Millisecond)
+	assert.GreaterOrEqual(t, gaps[1], 40*time.Millisecond)
+	assert.GreaterOrEqual(t, gaps[2], 40*time.Millisecond)
+	// Empty responses are not retried in a busy loop - the interval starts
+	// when the client sends the request, a bit before the server sees it.
+	assert.GreaterOrEqual(t, gaps[3], 45*time.Millisecond)
+	assert.GreaterOrEqual(t, gaps[4], 45*time.Millisecond)
+}
@@ -0,0 +1,285 @@
+// This file formats the poll reports of the schedule, who and stats commands.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/bergmannf/rpgreminder/telegram"
+)
+
+type OutputFormat = string
+
+const OUTPUT_TABLE OutputFormat = "table"
+const OUTPUT_JSON OutputFormat = "json"
+const OUTPUT_CSV OutputFormat = "csv"
+const OUTPUT_MARKDOWN OutputFormat = "markdown"
+
+var outputFormats = []OutputFormat{OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_CSV, OUTPUT_MARKDOWN}
+
+// Version of the JSON document, only increased for incompatible changes so
+// scripts can rely on the field names. Version 2 lists users without a vote
+// under none instead of no.
+const reportSchemaVersion int = 2
+
+func parseOutputFormat(format string) (OutputFormat, error) {
+	if !slices.Contains(outputFormats, format) {
+		return "", fmt.Errorf("unknown output format '%s', use one of %s", format, strings.Join(outputFormats, ", "))
+	}
+	return format, nil
+}
+
+// The users that gave each answer. Users who voted on other options of the
+// poll but not on this one are listed under none.
+type AnswerUsers struct {
+	Yes   []string `json:"yes"`
+	Maybe []string `json:"maybe"`
+	No    []string `json:"no"`
+	None  []string `json:"none"`
+}
+
+// Dates are in UTC, the weekday is the one of the local time zone
+type OptionReport struct {
+	Id      int         `json:"id"`
+	Date    time.Time   `json:"date"`
+	Weekday string      `json:"weekday"`
+	Yes     int         `json:"yes"`
+	Maybe   int         `json:"maybe"`
+	No      int         `json:"no"`
+	None    int         `json:"none"`
+	Percent float64     `json:"percent"`
+	Users   AnswerUsers `json:"users"`
+}
+
+// How often a user answered the options in the time frame. Options without a
+// vote of the user count as unavailable.
+type UserReport struct {
+	Name    string  `json:"name"`
+	Yes     int     `json:"yes"`
+	Maybe   int     `json:"maybe"`
+	No      int     `json:"no"`
+	None    int     `json:"none"`
+	Percent float64 `json:"percent"`
+}
+
+type PollReport struct {
+	// The entry of nextcloud_accounts - empty for the nextcloud section
+	Account string         `json:"account"`
+	PollId  int            `json:"poll_id"`
+	Options []OptionReport `json:"options"`
+	Users   []UserReport   `json:"users"`
+}
+
+// The document printed by all report commands
+type Report struct {
+	SchemaVersion int          `json:"schema_version"`
+	From          time.Time    `json:"from"`
+	To            time.Time    `json:"to"`
+	Polls         []PollReport `json:"polls"`
+}
+
+// The rows of a report in the table, csv and markdown formats. Rows for
+// machines use RFC 3339 dates and plain numbers.
+type reportTable struct {
+	header []string
+	rows   func(poll PollReport, machine bool) [][]string
+}
+
+// Share of yes and maybe answers in percent
+func percent(yes int, maybe int, no int, none int) float64 {
+	all := yes + maybe + no + none
+	if all == 0 {
+		return 0
+	}
+	return float64(yes+maybe) / float64(all) * 100
+}
+
+// Build the report of the options with their votes
+func pollReport(mapping telegram.ChannelPollMapping, options []nextcloud.PollOption, votes []nextcloud.PollVote) PollReport {
+	snapshot := nextcloud.TakeSnapshot(&nextcloud.PollOptions{Options: options}, votes)
+	names := map[string]bool{}
+	for _, option := range snapshot.Options {
+		for name := range option.Answers {
+			names[name] = true
+		}
+	}
+	users := map[string]*UserReport{}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		users[name] = &UserReport{Name: name}
+	}
+	report := PollReport{Account: mapping.Account, PollId: mapping.PollId, Options: []OptionReport{}, Users: []UserReport{}}
+	for _, opt := range options {
+		option := OptionReport{
+			Id:      opt.Id,
+			Date:    opt.Datetime().UTC(),
+			Weekday: opt.Datetime().Weekday().String(),
+			Yes:     opt.Votes.Yes,
+			Maybe:   opt.Votes.Maybe,
+			No:      opt.Votes.No,
+			// Only of the votes, like the poll shows it
+			Percent: percent(opt.Votes.Yes, opt.Votes.Maybe, opt.Votes.No, 0),
+			Users:   AnswerUsers{Yes: []string{}, Maybe: []string{}, No: []string{}, None: []string{}},
+		}
+		answers := snapshot.Options[opt.Id].Answers
+		for _, name := range slices.Sorted(maps.Keys(names)) {
+			switch answers[name] {
+			case "yes":
+				option.Users.Yes = append(option.Users.Yes, name)
+				users[name].Yes++
+			case "maybe":
+				option.Users.Maybe = append(option.Users.Maybe, name)
+				users[name].Maybe++
+			case "no":
+				option.Users.No = append(option.Users.No, name)
+				users[name].No++
+			default:
+				option.Users.None = append(option.Users.None, name)
+				users[name].None++
+			}
+		}
+		option.None = len(option.Users.None)
+		report.Options = append(report.Options, option)
+	}
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		user := users[name]
+		user.Percent = percent(user.Yes, user.Maybe, user.No, user.None)
+		report.Users = append(report.Users, *user)
+	}
+	return report
+}
+
+// The poll in tables - polls of nextcloud_accounts are prefixed with the
+// name of the account, as their IDs are only unique per account.
+func (p PollReport) name() string {
+	if p.Account == nextcloud.DEFAULT_ACCOUNT {
+		return strconv.Itoa(p.PollId)
+	}
+	return p.Account + "/" + strconv.Itoa(p.PollId)
+}
+
+func formatPercent(p float64, machine bool) string {
+	if machine {
+		return strconv.FormatFloat(p, 'f', 2, 64)
+	}
+	return fmt.Sprintf("%.2f %%", p)
+}
+
+func formatDate(date time.Time, layout string, machine bool) string {
+	if machine {
+		return date.Format(time.RFC3339)
+	}
+	return date.Local().Format(layout)
+}
+
+var scheduleTable = reportTable{
+	header: []string{"Poll", "Weekday", "Date", "Yes", "No", "Maybe", "Total"},
+	rows: func(poll PollReport, machine bool) [][]string {
+		rows := [][]string{}
+		for _, o := range poll.Options {
+			rows = append(rows, []string{poll.name(), o.Weekday, formatDate(o.Date, "02/01", machine), strconv.Itoa(o.Yes), strconv.Itoa(o.No), strconv.Itoa(o.Maybe), formatPercent(o.Percent, machine)})
+		}
+		return rows
+	},
+}
+
+var whoTable = reportTable{
+	header: []string{"Poll", "Date", "Yes", "Maybe", "No", "No vote"},
+	rows: func(poll PollReport, machine bool) [][]string {
+		rows := [][]string{}
+		for _, o := range poll.Options {
+			rows = append(rows, []string{poll.name(), formatDate(o.Date, "Mon 02/01 15:04", machine), strings.Join(o.Users.Yes, ", "), strings.Join(o.Users.Maybe, ", "), strings.Join(o.Users.No, ", "), strings.Join(o.Users.None, ", ")})
+		}
+		return rows
+	},
+}
+
+var statsTable = reportTable{
+	header: []string{"Poll", "User", "Yes", "Maybe", "No", "No vote", "Available"},
+	rows: func(poll PollReport, machine bool) [][]string {
+		rows := [][]string{}
+		for _, u := range poll.Users {
+			rows = append(rows, []string{poll.name(), u.Name, strconv.Itoa(u.Yes), strconv.Itoa(u.Maybe), strconv.Itoa(u.No), strconv.Itoa(u.None), formatPercent(u.Percent, machine)})
+		}
+		return rows
+	},
+}
+
+// Write the report in the format. JSON always contains the full report, the
+// other formats only the columns of the table.
+func (r *Report) Write(w io.Writer, format OutputFormat, table reportTable) error {
+	rows := [][]string{}
+	for _, poll := range r.Polls {
+		rows = append(rows, table.rows(poll, format == OUTPUT_CSV)...)
+	}
+	switch format {
+	case OUTPUT_JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(r)
+	case OUTPUT_CSV:
+		writer := csv.NewWriter(w)
+		err := writer.WriteAll(append([][]string{table.header}, rows...))
+		if err != nil {
+			return err
+		}
+		return writer.Error()
+	case OUTPUT_MARKDOWN:
+		lines := []string{markdownRow(table.header), "|" + strings.Repeat("---|", len(table.header))}
+		for _, row := range rows {
+			lines = append(lines, markdownRow(row))
+		}
+		_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n")
+		return err
+	case OUTPUT_TABLE:
+		if len(rows) == 0 {
+			_, err := io.WriteString(w, "Nothing in that time frame.\n")
+			return err
+		}
+		_, err := io.WriteString(w, alignedTable(table.header, rows))
+		return err
+	}
+	return fmt.Errorf("unknown output format '%s', use one of %s", format, strings.Join(outputFormats, ", "))
+}
+
+func markdownRow(row []string) string {
+	escaped := []string{}
+	for _, cell := range row {
+		escaped = append(escaped, strings.ReplaceAll(cell, "|", `\|`))
+	}
+	return "| " + strings.Join(escaped, " | ") + " |"
+}
+
+// Pad the columns to the widest cell, numbers are aligned to the right
+func alignedTable(header []string, rows [][]string) string {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len([]rune(cell)))
+		}
+	}
+	format := func(row []string, header bool) string {
+		cells := []string{}
+		for i, cell := range row {
+			padding := strings.Repeat(" ", widths[i]-len([]rune(cell)))
+			if _, err := strconv.ParseFloat(strings.TrimSuffix(cell, " %"), 64); err == nil && !header {
+				cells = append(cells, padding+cell)
+			} else {
+				cells = append(cells, cell+padding)
+			}
+		}
+		return "| " + strings.Join(cells, " | ") + " |\n"
+	}
+	table := format(header, true)
+	for _, row := range rows {
+		table += format(row, false)
+	}
+	return table
+}
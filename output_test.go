@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/bergmannf/rpgreminder/telegram"
+	"github.com/stretchr/testify/assert"
+)
+
+func testReport() *Report {
+	date := time.Date(2026, 10, 24, 18, 0, 0, 0, time.UTC)
+	options := []nextcloud.PollOption{
+		{Id: 7, Timestamp: date.Unix(), Votes: nextcloud.PollOptionVote{Yes: 1, Maybe: 1, No: 1}},
+		{Id: 8, Timestamp: date.Add(24 * time.Hour).Unix(), Votes: nextcloud.PollOptionVote{Yes: 0, Maybe: 0, No: 1}},
+	}
+	votes := []nextcloud.PollVote{
+		{OptionId: 7, Answer: "yes", User: nextcloud.PollUser{DisplayName: "anna"}},
+		{OptionId: 7, Answer: "maybe", User: nextcloud.PollUser{DisplayName: "bob"}},
+		{OptionId: 7, Answer: "no", User: nextcloud.PollUser{DisplayName: "carl"}},
+		{OptionId: 8, Answer: "no", User: nextcloud.PollUser{DisplayName: "anna"}},
+	}
+	return &Report{SchemaVersion: reportSchemaVersion, From: date, To: date.Add(7 * 24 * time.Hour), Polls: []PollReport{pollReport(telegram.ChannelPollMapping{PollId: 3}, options, votes)}}
+}
+
+func TestPollReport(t *testing.T) {
+	poll := testReport().Polls[0]
+	assert.Equal(t, AnswerUsers{Yes: []string{"anna"}, Maybe: []string{"bob"}, No: []string{"carl"}, None: []string{}}, poll.Options[0].Users)
+	// Users without a vote are listed separately, the counts match the lists
+	assert.Equal(t, AnswerUsers{Yes: []string{}, Maybe: []string{}, No: []string{"anna"}, None: []string{"bob", "carl"}}, poll.Options[1].Users)
+	assert.Equal(t, 1, poll.Options[1].No)
+	assert.Equal(t, 2, poll.Options[1].None)
+	assert.InDelta(t, 66.67, poll.Options[0].Percent, 0.01)
+	assert.Equal(t, 0.0, poll.Options[1].Percent)
+	assert.Equal(t, []UserReport{
+		{Name: "anna", Yes: 1, No: 1, Percent: 50},
+		{Name: "bob", Maybe: 1, None: 1, Percent: 50},
+		{Name: "carl", No: 1, None: 1, Percent: 0},
+	}, poll.Users)
+}
+
+func TestWriteReport(t *testing.T) {
+	report := testReport()
+	var out bytes.Buffer
+
+	assert.NoError(t, report.Write(&out, OUTPUT_JSON, scheduleTable))
+	var decoded map[string]any
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, 2.0, decoded["schema_version"])
+	option := decoded["polls"].([]any)[0].(map[string]any)["options"].([]any)[0].(map[string]any)
+	assert.Equal(t, "2026-10-24T18:00:00Z", option["date"])
+	assert.Equal(t, map[string]any{"yes": []any{"anna"}, "maybe": []any{"bob"}, "no": []any{"carl"}, "none": []any{}}, option["users"])
+
+	out.Reset()
+	assert.NoError(t, report.Write(&out, OUTPUT_CSV, statsTable))
+	assert.Equal(t, "Poll,User,Yes,Maybe,No,No vote,Available\n3,anna,1,0,1,0,50.00\n3,bob,0,1,0,1,50.00\n3,carl,0,0,1,1,0.00\n", out.String())
+
+	out.Reset()
+	assert.NoError(t, report.Write(&out, OUTPUT_CSV, scheduleTable))
+	assert.Contains(t, out.String(), "3,Saturday,2026-10-24T18:00:00Z,1,1,1,66.67\n")
+
+	out.Reset()
+	assert.NoError(t, report.Write(&out, OUTPUT_MARKDOWN, whoTable))
+	assert.Contains(t, out.String(), "| Poll | Date | Yes | Maybe | No | No vote |\n|---|---|---|---|---|---|\n")
+	sunday := time.Date(2026, 10, 25, 18, 0, 0, 0, time.UTC).Local().Format("Mon 02/01 15:04")
+	assert.Contains(t, out.String(), "| 3 | "+sunday+" |  |  | anna | bob, carl |\n")
+
+	out.Reset()
+	report.Polls[0].Options = report.Polls[0].Options[:1]
+	assert.NoError(t, report.Write(&out, OUTPUT_TABLE, scheduleTable))
+	assert.Equal(t, "| Poll | Weekday  | Date  | Yes | No | Maybe | Total   |\n|    3 | Saturday | 24/10 |   1 |  1 |     1 | 66.67 % |\n", out.String())
+
+	_, err := parseOutputFormat("xml")
+	assert.Error(t, err)
+}
+
+func TestPollName(t *testing.T) {
+	assert.Equal(t, "3", PollReport{PollId: 3}.name())
+	assert.Equal(t, "club/3", PollReport{Account: "club", PollId: 3}.name())
+}
@@ -0,0 +1,197 @@
+// This file parses the arguments that can be passed to the bot commands.
+package telegram
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dateFormat string = "2006-01-02"
+
+// Default number of weekends added by /extendpoll
+const DefaultExtendWeekends int = 4
+
+// Upper bound for /extendpoll so a typo does not flood the poll
+const maxExtendWeekends int = 26
+
+// Parse a date in the format YYYY-MM-DD in the local timezone
+func parseDate(value string) (time.Time, error) {
+	date, err := time.ParseInLocation(dateFormat, value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is not a valid date, use the format YYYY-MM-DD (e.g. 2026-11-01)", value)
+	}
+	return date, nil
+}
+
+// Parse a duration like 10d or 3w
+func parseDays(value string) (int, error) {
+	if len(value) < 2 {
+		return 0, fmt.Errorf("'%s' is not a valid duration, use e.g. 10d or 3w", value)
+	}
+	unit := value[len(value)-1]
+	count, err := strconv.Atoi(value[:len(value)-1])
+	if err != nil || count <= 0 {
+		return 0, fmt.Errorf("'%s' is not a valid duration, use a positive number followed by d or w", value)
+	}
+	switch unit {
+	case 'd':
+		return count, nil
+	case 'w':
+		return count * 7, nil
+	}
+	return 0, fmt.Errorf("'%s' has an unknown unit, use d for days or w for weeks", value)
+}
+
+// Parse the arguments of /schedule and return the window of dates to print.
+//
+// Supported are no arguments (the next 7 days), a duration (10d, 3w) or a
+// range of dates (2026-11-01..2026-11-30) where both days are included.
+func ParseScheduleArgs(args []string, now time.Time) (time.Time, time.Time, error) {
+	if len(args) == 0 {
+		return now, now.Add(7 * 24 * time.Hour), nil
+	}
+	if len(args) > 1 {
+		return time.Time{}, time.Time{}, fmt.Errorf("/schedule takes at most one argument, e.g. /schedule 3w or /schedule 2026-11-01..2026-11-30")
+	}
+	arg := args[0]
+	if start, end, found := strings.Cut(arg, ".."); found {
+		from, err := parseDate(start)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		to, err := parseDate(end)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		if to.Before(from) {
+			return time.Time{}, time.Time{}, fmt.Errorf("the range '%s' ends before it starts", arg)
+		}
+		// Include options that fall on the first and the last day.
+		return from.Add(-time.Second), to.AddDate(0, 0, 1), nil
+	}
+	days, err := parseDays(arg)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return now, now.AddDate(0, 0, days), nil
+}
+
+// Parse the arguments of /extendpoll and return the number of weekends to add.
+func parseExtendArgs(args []string) (int, error) {
+	if len(args) == 0 {
+		return DefaultExtendWeekends, nil
+	}
+	if len(args) > 1 {
+		return 0, fmt.Errorf("/extendpoll takes at most one argument, e.g. /extendpoll 6")
+	}
+	weekends, err := strconv.Atoi(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a number, use e.g. /extendpoll 6", args[0])
+	}
+	return weekends, ValidateWeekends(weekends)
+}
+
+// Check the number of weekends that are added to a poll at once
+func ValidateWeekends(weekends int) error {
+	if weekends < 1 || weekends > maxExtendWeekends {
+		return fmt.Errorf("the number of weekends must be between 1 and %d", maxExtendWeekends)
+	}
+	return nil
+}
+
+// Parse the arguments of /cleanup and return the date before which options
+// are removed.
+//
+// Without arguments all options in the past are removed, otherwise
+// `before YYYY-MM-DD` limits the removal to options before that day.
+func ParseCleanupArgs(args []string, now time.Time) (time.Time, error) {
+	if len(args) == 0 {
+		return now, nil
+	}
+	if len(args) != 2 || args[0] != "before" {
+		return time.Time{}, fmt.Errorf("use /cleanup or /cleanup before YYYY-MM-DD")
+	}
+	before, err := parseDate(args[1])
+	if err != nil {
+		return time.Time{}, err
+	}
+	if before.After(now) {
+		return time.Time{}, fmt.Errorf("refusing to remove options that are still in the future (%s)", args[1])
+	}
+	return before, nil
+}
+
+// Parse the arguments of /summary and return the time from which messages are
+// summarized. A zero time means the caller picks the start.
+//
+// Supported are no arguments, a duration (3d, 2w) or a date (2026-11-01).
+func parseSummaryArgs(args []string, now time.Time) (time.Time, error) {
+	if len(args) == 0 {
+		return time.Time{}, nil
+	}
+	if len(args) > 1 {
+		return time.Time{}, fmt.Errorf("/summary takes at most one argument, e.g. /summary 3d or /summary 2026-11-01")
+	}
+	if strings.Contains(args[0], "-") {
+		since, err := parseDate(args[0])
+		if err != nil {
+			return time.Time{}, err
+		}
+		if since.After(now) {
+			return time.Time{}, fmt.Errorf("%s is in the future", args[0])
+		}
+		return since, nil
+	}
+	days, err := parseDays(args[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.AddDate(0, 0, -days), nil
+}
+
+// Parse the arguments of /export and return the format and the time frame of
+// the export. Zero times do not restrict the export.
+//
+// Supported are an optional format (json, md or csv) followed by an optional
+// duration (3w exports the last three weeks), a date (everything since
+// 2026-10-01) or a range of dates (2026-10-01..2026-10-31).
+func ParseExportArgs(args []string, now time.Time) (ExportFormat, time.Time, time.Time, error) {
+	format := EXPORT_JSON
+	if len(args) > 0 && slices.Contains(exportFormats, strings.ToLower(args[0])) {
+		format = strings.ToLower(args[0])
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return format, time.Time{}, time.Time{}, nil
+	}
+	if len(args) > 1 {
+		return "", time.Time{}, time.Time{}, fmt.Errorf("use /export [json|md|csv] [3w|2026-10-01|2026-10-01..2026-10-31]")
+	}
+	arg := args[0]
+	if start, end, found := strings.Cut(arg, ".."); found {
+		from, err := parseDate(start)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, err
+		}
+		to, err := parseDate(end)
+		if err != nil {
+			return "", time.Time{}, time.Time{}, err
+		}
+		if to.Before(from) {
+			return "", time.Time{}, time.Time{}, fmt.Errorf("the range '%s' ends before it starts", arg)
+		}
+		return format, from, to.AddDate(0, 0, 1), nil
+	}
+	if strings.Contains(arg, "-") {
+		since, err := parseDate(arg)
+		return format, since, time.Time{}, err
+	}
+	days, err := parseDays(arg)
+	if err != nil {
+		return "", time.Time{}, time.Time{}, err
+	}
+	return format, now.AddDate(0, 0, -days), time.Time{}, nil
+}
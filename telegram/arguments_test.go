@@ -0,0 +1,117 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScheduleArgs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+
+	from, to, err := ParseScheduleArgs(nil, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, from)
+	assert.Equal(t, now.AddDate(0, 0, 7), to)
+
+	from, to, err = ParseScheduleArgs([]string{"3w"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, from)
+	assert.Equal(t, now.AddDate(0, 0, 21), to)
+
+	from, to, err = ParseScheduleArgs([]string{"2026-11-01..2026-11-30"}, now)
+	assert.NoError(t, err)
+	assert.True(t, from.Before(time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local)))
+	assert.Equal(t, time.Date(2026, 12, 1, 0, 0, 0, 0, time.Local), to)
+
+	for _, args := range [][]string{
+		{"3x"},
+		{"w"},
+		{"-2d"},
+		{"2026-11-30..2026-11-01"},
+		{"2026-13-01..2026-11-30"},
+		{"3w", "4w"},
+	} {
+		_, _, err = ParseScheduleArgs(args, now)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestParseExtendArgs(t *testing.T) {
+	weekends, err := parseExtendArgs(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultExtendWeekends, weekends)
+
+	weekends, err = parseExtendArgs([]string{"6"})
+	assert.NoError(t, err)
+	assert.Equal(t, 6, weekends)
+
+	for _, args := range [][]string{{"0"}, {"six"}, {"100"}, {"1", "2"}} {
+		_, err = parseExtendArgs(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestParseCleanupArgs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+
+	before, err := ParseCleanupArgs(nil, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now, before)
+
+	before, err = ParseCleanupArgs([]string{"before", "2026-10-01"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), before)
+
+	for _, args := range [][]string{{"2026-10-01"}, {"after", "2026-10-01"}, {"before", "2027-01-01"}, {"before", "yesterday"}} {
+		_, err = ParseCleanupArgs(args, now)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestParseSummaryArgs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	since, err := parseSummaryArgs(nil, now)
+	assert.NoError(t, err)
+	assert.True(t, since.IsZero())
+
+	since, err = parseSummaryArgs([]string{"3d"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, now.AddDate(0, 0, -3), since)
+
+	since, err = parseSummaryArgs([]string{"2026-10-01"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), since)
+
+	_, err = parseSummaryArgs([]string{"2026-11-01"}, now)
+	assert.Error(t, err)
+	_, err = parseSummaryArgs([]string{"3d", "4d"}, now)
+	assert.Error(t, err)
+}
+
+func TestParseExportArgs(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.Local)
+	format, since, until, err := ParseExportArgs(nil, now)
+	assert.NoError(t, err)
+	assert.Equal(t, EXPORT_JSON, format)
+	assert.True(t, since.IsZero())
+	assert.True(t, until.IsZero())
+
+	format, since, until, err = ParseExportArgs([]string{"CSV", "2w"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, EXPORT_CSV, format)
+	assert.Equal(t, now.AddDate(0, 0, -14), since)
+	assert.True(t, until.IsZero())
+
+	format, since, until, err = ParseExportArgs([]string{"md", "2026-10-01..2026-10-31"}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, EXPORT_MARKDOWN, format)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.Local), since)
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.Local), until)
+
+	_, _, _, err = ParseExportArgs([]string{"pdf"}, now)
+	assert.Error(t, err)
+	_, _, _, err = ParseExportArgs([]string{"json", "3w", "extra"}, now)
+	assert.Error(t, err)
+}
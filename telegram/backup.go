@@ -0,0 +1,250 @@
+// This file creates and restores copies of the database while the bot is running.
+package telegram
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// Backups are named messages-20261018-191600.db
+const backupPrefix string = "messages-"
+const backupSuffix string = ".db"
+const backupTimeFormat string = "20060102-150405"
+
+// Number of backups kept if the configuration does not set it
+const defaultBackupKeep int = 7
+
+// How often the bot checks whether a backup is due
+const backupCheckInterval time.Duration = time.Minute
+
+// Pages copied at once - the database is only locked while a step runs, so
+// the bot can keep writing in between.
+const backupStepPages int = 100
+
+type BackupConfig struct {
+	// Directory the backups are written to - no backups are made if empty
+	Directory string `json:"directory"`
+	// Hours between two scheduled backups - 0 only allows manual backups
+	IntervalHours int `json:"interval_hours"`
+	// Number of backups that are kept, older ones are removed
+	Keep int `json:"keep"`
+}
+
+func (c BackupConfig) keep() int {
+	if c.Keep <= 0 {
+		return defaultBackupKeep
+	}
+	return c.Keep
+}
+
+// Copy the database src into dest with the online backup API of SQLite
+func copyDatabase(src *sql.DB, dest *sql.DB) error {
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	return destConn.Raw(func(destDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			destSqlite, ok := destDriver.(*sqlite3.SQLiteConn)
+			srcSqlite, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("backups are only supported for SQLite databases")
+			}
+			backup, err := destSqlite.Backup("main", srcSqlite, "main")
+			if err != nil {
+				return err
+			}
+			for {
+				done, err := backup.Step(backupStepPages)
+				if err != nil {
+					backup.Close()
+					return err
+				}
+				if done {
+					return backup.Finish()
+				}
+				// Give the bot a chance to write, the backup restarts
+				// automatically if the database changed in between.
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	})
+}
+
+// Write a consistent copy of the database to the path. The copy is written to
+// a temporary file first, so an interrupted backup never looks complete.
+func (db *MessageDB) Backup(path string) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	dest, err := sql.Open("sqlite3", tmp)
+	if err != nil {
+		return err
+	}
+	err = copyDatabase(db.connection, dest)
+	dest.Close()
+	if err == nil {
+		err = CheckBackup(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Make sure the file is an intact database this version of the bot can use
+func CheckBackup(path string) error {
+	_, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	rows, err := conn.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return fmt.Errorf("%s is not a valid database: %w", path, err)
+	}
+	problems := []string{}
+	for rows.Next() {
+		var result string
+		err = rows.Scan(&result)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	rows.Close()
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is corrupt: %s", path, strings.Join(problems, "; "))
+	}
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("%s has schema version %d, but this version of the bot only knows %d", path, version, LatestSchemaVersion())
+	}
+	return nil
+}
+
+// The backups in the directory, oldest first
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix) {
+			backups = append(backups, filepath.Join(dir, name))
+		}
+	}
+	// The timestamp in the name sorts chronologically.
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// Write a new backup into the configured directory and remove the oldest
+// backups that exceed the retention count. Returns the path of the backup.
+func (db *MessageDB) BackupTo(config BackupConfig, now time.Time) (string, error) {
+	err := os.MkdirAll(config.Directory, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(config.Directory, backupPrefix+now.UTC().Format(backupTimeFormat)+backupSuffix)
+	err = db.Backup(path)
+	if err != nil {
+		return "", err
+	}
+	backups, err := ListBackups(config.Directory)
+	if err != nil {
+		return path, err
+	}
+	for len(backups) > config.keep() {
+		err = os.Remove(backups[0])
+		if err != nil {
+			return path, err
+		}
+		log.Print("Removed old backup ", backups[0])
+		backups = backups[1:]
+	}
+	return path, nil
+}
+
+// Replace the content of the database at target with the backup. The backup
+// is checked first, so a broken backup never overwrites the database. Fails
+// with ErrDatabaseInUse while a bot uses the database.
+func RestoreBackup(backup string, target string) error {
+	err := CheckBackup(backup)
+	if err != nil {
+		return err
+	}
+	lock, err := lockDatabase(target, true)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	src, err := sql.Open("sqlite3", "file:"+backup+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := sql.Open("sqlite3", target)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return copyDatabase(src, dest)
+}
+
+// Whether the next scheduled backup is due, the last one was made at last
+func backupDue(config BackupConfig, last time.Time, now time.Time) bool {
+	if config.Directory == "" || config.IntervalHours <= 0 {
+		return false
+	}
+	return !now.Before(last.Add(time.Duration(config.IntervalHours) * time.Hour))
+}
+
+// Back up the database periodically if backups are configured. The settings
+// are read on every check, so reloading the configuration changes them.
+func (t *TelegramBot) BackupPeriodically() {
+	ticker := time.NewTicker(backupCheckInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for now := range ticker.C {
+		config := t.config().Backup
+		if !backupDue(config, last, now) {
+			continue
+		}
+		last = now
+		path, err := t.db.BackupTo(config, now)
+		if err != nil {
+			log.Print("Could not back up the database: ", err)
+			continue
+		}
+		log.Print("Backed up the database to ", path)
+	}
+}
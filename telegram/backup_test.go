@@ -0,0 +1,100 @@
+package telegram
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenDatabase(filepath.Join(dir, "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	_, err = db.SaveMessage(&DBMessage{MsgId: 1, ChannelId: 1001, Date: time.Now(), User: "anna", Text: "first", Type: RECEIVED})
+	assert.NoError(t, err)
+
+	config := BackupConfig{Directory: filepath.Join(dir, "backups"), Keep: 2}
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	first, err := db.BackupTo(config, now)
+	assert.NoError(t, err)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 2, ChannelId: 1001, Date: time.Now(), User: "anna", Text: "second", Type: RECEIVED})
+	assert.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		_, err = db.BackupTo(config, now.Add(time.Duration(i)*time.Hour))
+		assert.NoError(t, err)
+	}
+	// Only the two newest backups are kept
+	backups, err := ListBackups(config.Directory)
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	assert.NotContains(t, backups, first)
+	assert.Equal(t, filepath.Join(config.Directory, "messages-20261018-140000.db"), backups[1])
+
+	restored := filepath.Join(dir, "restored.db")
+	// A running bot keeps the database from being replaced
+	lock, err := lockDatabase(restored, false)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, RestoreBackup(backups[1], restored), ErrDatabaseInUse)
+	lock.Close()
+	assert.NoError(t, RestoreBackup(backups[1], restored))
+	restoredDb, err := OpenDatabase(restored)
+	assert.NoError(t, err)
+	defer restoredDb.Close()
+	count, err := restoredDb.Count(1001, MessageFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	// A broken backup never replaces the database
+	broken := filepath.Join(dir, "broken.db")
+	assert.NoError(t, os.WriteFile(broken, []byte("not a database"), 0600))
+	assert.Error(t, RestoreBackup(broken, restored))
+	assert.Error(t, RestoreBackup(filepath.Join(dir, "missing.db"), restored))
+	count, err = restoredDb.Count(1001, MessageFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func TestBackupWithoutMigrating(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "messages.db")
+	conn, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// A bot of an older version uses the database
+	_, err = conn.Exec(v0Table)
+	assert.NoError(t, err)
+	conn.Close()
+
+	db, err := OpenReadOnly(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	backup, err := db.BackupTo(BackupConfig{Directory: filepath.Join(dir, "backups")}, time.Now())
+	assert.NoError(t, err)
+	for _, path := range []string{path, backup} {
+		version, err := DatabaseSchemaVersion(path)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, version)
+	}
+	_, err = OpenReadOnly(filepath.Join(dir, "missing.db"))
+	assert.Error(t, err)
+}
+
+func TestBackupDue(t *testing.T) {
+	last := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	config := BackupConfig{Directory: "backups", IntervalHours: 6}
+	assert.False(t, backupDue(config, last, last.Add(5*time.Hour)))
+	assert.True(t, backupDue(config, last, last.Add(6*time.Hour)))
+	// A shorter interval after a reload applies to the running schedule
+	config.IntervalHours = 2
+	assert.True(t, backupDue(config, last, last.Add(5*time.Hour)))
+	assert.False(t, backupDue(BackupConfig{IntervalHours: 2}, last, last.Add(5*time.Hour)))
+	assert.False(t, backupDue(BackupConfig{Directory: "backups"}, last, last.Add(5*time.Hour)))
+}
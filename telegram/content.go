@@ -0,0 +1,85 @@
+// This file extracts media, replies and forwards from received messages.
+package telegram
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mymmrac/telego"
+)
+
+const TEXT_CONTENT string = "text"
+
+var MESSAGES_CONTENT = []string{
+	`ALTER TABLE messages ADD COLUMN contentType TEXT NOT NULL DEFAULT 'text'`,
+	`ALTER TABLE messages ADD COLUMN caption TEXT`,
+	`ALTER TABLE messages ADD COLUMN fileId TEXT`,
+	`ALTER TABLE messages ADD COLUMN replyTo INTEGER`,
+	`ALTER TABLE messages ADD COLUMN forwardFrom TEXT`,
+}
+
+// Fill the content type, caption, file ID, reply and forward origin of the
+// stored message from the Telegram message.
+func setContent(stored *DBMessage, msg *telego.Message) {
+	stored.ContentType, stored.Caption, stored.FileId = messageContent(msg)
+	if msg.ReplyToMessage != nil {
+		stored.ReplyTo = msg.ReplyToMessage.MessageID
+	}
+	if msg.ForwardOrigin != nil {
+		stored.ForwardFrom = forwardOrigin(msg.ForwardOrigin)
+	}
+}
+
+// Return the content type, caption and file ID of the message
+func messageContent(msg *telego.Message) (string, string, string) {
+	switch {
+	case len(msg.Photo) > 0:
+		// The last size is the largest one.
+		return "photo", msg.Caption, msg.Photo[len(msg.Photo)-1].FileID
+	case msg.Document != nil:
+		return "document", msg.Caption, msg.Document.FileID
+	case msg.Sticker != nil:
+		return "sticker", msg.Sticker.Emoji, msg.Sticker.FileID
+	case msg.Animation != nil:
+		return "animation", msg.Caption, msg.Animation.FileID
+	case msg.Video != nil:
+		return "video", msg.Caption, msg.Video.FileID
+	case msg.VideoNote != nil:
+		return "video_note", "", msg.VideoNote.FileID
+	case msg.Voice != nil:
+		return "voice", msg.Caption, msg.Voice.FileID
+	case msg.Audio != nil:
+		return "audio", msg.Caption, msg.Audio.FileID
+	case msg.Poll != nil:
+		options := []string{}
+		for _, option := range msg.Poll.Options {
+			options = append(options, option.Text)
+		}
+		return "poll", fmt.Sprintf("%s (%s)", msg.Poll.Question, strings.Join(options, ", ")), ""
+	case msg.Location != nil:
+		return "location", fmt.Sprintf("%f,%f", msg.Location.Latitude, msg.Location.Longitude), ""
+	case msg.Contact != nil:
+		return "contact", strings.TrimSpace(msg.Contact.FirstName + " " + msg.Contact.LastName), ""
+	case msg.Dice != nil:
+		return "dice", fmt.Sprintf("%s %d", msg.Dice.Emoji, msg.Dice.Value), ""
+	}
+	return TEXT_CONTENT, msg.Caption, ""
+}
+
+// Describe where a forwarded message came from
+func forwardOrigin(origin telego.MessageOrigin) string {
+	switch o := origin.(type) {
+	case *telego.MessageOriginUser:
+		if o.SenderUser.Username != "" {
+			return o.SenderUser.Username
+		}
+		return strings.TrimSpace(o.SenderUser.FirstName + " " + o.SenderUser.LastName)
+	case *telego.MessageOriginHiddenUser:
+		return o.SenderUserName
+	case *telego.MessageOriginChat:
+		return o.SenderChat.Title
+	case *telego.MessageOriginChannel:
+		return o.Chat.Title
+	}
+	return origin.OriginType()
+}
@@ -0,0 +1,107 @@
+package telegram
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageContent(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	key, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(key)
+
+	msg := &telego.Message{
+		MessageID:      12,
+		Caption:        "Map of the dungeon",
+		Photo:          []telego.PhotoSize{{FileID: "small"}, {FileID: "large"}},
+		ReplyToMessage: &telego.Message{MessageID: 7},
+		ForwardOrigin:  &telego.MessageOriginHiddenUser{Type: "hidden_user", SenderUserName: "Gandalf"},
+	}
+	stored := &DBMessage{MsgId: 12, ChannelId: 1001, Date: time.Unix(1625648400, 0).UTC(), User: "anna", Type: RECEIVED}
+	setContent(stored, msg)
+	_, err = db.SaveMessage(stored)
+	assert.NoError(t, err)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 13, ChannelId: 1001, Date: time.Unix(1625648500, 0).UTC(), User: "anna", Text: "hello", Type: RECEIVED})
+	assert.NoError(t, err)
+
+	received, err := db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, received, 2)
+	assert.Equal(t, "photo", received[0].ContentType)
+	assert.Equal(t, "Map of the dungeon", received[0].Caption)
+	assert.Equal(t, "large", received[0].FileId)
+	assert.Equal(t, 7, received[0].ReplyTo)
+	assert.Equal(t, "Gandalf", received[0].ForwardFrom)
+	assert.Equal(t, TEXT_CONTENT, received[1].ContentType)
+
+	var caption string
+	err = db.connection.QueryRow("SELECT caption FROM messages WHERE msgId = 12").Scan(&caption)
+	assert.NoError(t, err)
+	assert.NotContains(t, caption, "dungeon")
+
+	cleared, err := db.ClearText(1001, RECEIVED)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cleared)
+	received, err = db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, received[0].Caption)
+	assert.Equal(t, "large", received[0].FileId)
+}
+
+func TestMetadataOnly(t *testing.T) {
+	store := NewMemoryStore()
+	bot := &TelegramBot{
+		configuration: &TelegramConfig{ChannelsToPolls: []ChannelPollMapping{{ChannelId: 1001, PollId: 1, Retention: RetentionConfig{MetadataOnly: true}}}},
+		messages:      store,
+	}
+	chat := telego.Chat{ID: 1001}
+	messages := map[string]telego.Message{
+		TEXT_CONTENT: {Text: "the secret door is behind the statue"},
+		"photo":      {Caption: "Map of the dungeon", Photo: []telego.PhotoSize{{FileID: "photo"}}},
+		"sticker":    {Sticker: &telego.Sticker{Emoji: "🐉", FileID: "sticker"}},
+		"location":   {Location: &telego.Location{Latitude: 52.52, Longitude: 13.40}},
+		"contact":    {Contact: &telego.Contact{FirstName: "Anna", LastName: "Smith"}},
+		"dice":       {Dice: &telego.Dice{Emoji: "🎲", Value: 6}},
+		"poll":       {Poll: &telego.Poll{Question: "Pizza?", Options: []telego.PollOption{{Text: "yes"}}}},
+	}
+	id := 0
+	for contentType, msg := range messages {
+		id++
+		msg.MessageID, msg.Chat = id, chat
+		assert.NoError(t, bot.StoreNonCommand(nil, telego.Update{Message: &msg}))
+		// Edits of messages the bot does not know are stored the same way
+		msg.MessageID, msg.Chat = id+100, chat
+		assert.NoError(t, bot.StoreEdit(nil, telego.Update{EditedMessage: &msg}))
+
+		for _, msgId := range []int{id, id + 100} {
+			stored := []DBMessage{}
+			received, err := store.ListReceived(1001, time.Time{}, 0)
+			assert.NoError(t, err)
+			for _, r := range received {
+				if r.MsgId == msgId {
+					stored = append(stored, r)
+				}
+			}
+			assert.Len(t, stored, 1, contentType)
+			assert.Equal(t, contentType, stored[0].ContentType)
+			assert.Empty(t, stored[0].Text, contentType)
+			assert.Empty(t, stored[0].Caption, contentType)
+		}
+	}
+	received, err := store.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	for _, r := range received {
+		if r.ContentType == "photo" || r.ContentType == "sticker" {
+			assert.Equal(t, r.ContentType, r.FileId)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// This file notices Nextcloud app passwords that are no longer accepted.
+package telegram
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+)
+
+const credentialInterval time.Duration = time.Hour
+
+// The account as it is named in the configuration
+func accountName(account string) string {
+	if account == nextcloud.DEFAULT_ACCOUNT {
+		return "nextcloud"
+	}
+	return account
+}
+
+// The command that obtains a new app password for the account
+func loginCommand(account string) string {
+	if account == nextcloud.DEFAULT_ACCOUNT {
+		return "rpgreminder login"
+	}
+	return "rpgreminder login --account " + account
+}
+
+// The alerts for the results of a check, by account. Only changes are
+// reported, so the admin chat is not told every hour. revoked holds the
+// accounts that were rejected before and is updated.
+func credentialAlerts(accounts []string, results map[string]error, revoked map[string]bool) []string {
+	alerts := []string{}
+	for _, account := range accounts {
+		err, checked := results[account]
+		if !checked {
+			continue
+		}
+		rejected := errors.Is(err, nextcloud.ErrRevoked)
+		switch {
+		case rejected && !revoked[account]:
+			alerts = append(alerts, fmt.Sprintf(`⚠ - Nextcloud rejects the app password of the account '%s', it was probably revoked. Run "%s" and reload the bot.`, accountName(account), loginCommand(account)))
+		case !rejected && revoked[account]:
+			alerts = append(alerts, fmt.Sprintf(`🤖 - The Nextcloud account '%s' works again.`, accountName(account)))
+		}
+		revoked[account] = rejected
+	}
+	return alerts
+}
+
+// Check the credentials of every Nextcloud account regularly and tell the
+// admin chat about rejected ones.
+func (t *TelegramBot) CheckCredentialsPeriodically() {
+	ticker := time.NewTicker(credentialInterval)
+	defer ticker.Stop()
+	revoked := map[string]bool{}
+	for {
+		accounts := t.nextcloud.Accounts()
+		results := map[string]error{}
+		for _, account := range accounts {
+			client, err := t.nextcloud.Client(account)
+			if err != nil {
+				continue
+			}
+			err = client.CheckCredentials(context.Background())
+			if err != nil && !errors.Is(err, nextcloud.ErrRevoked) {
+				// An unreachable server says nothing about the credentials.
+				log.Print("Could not check the credentials of ", accountName(account), ": ", err)
+				continue
+			}
+			results[account] = err
+		}
+		for _, alert := range credentialAlerts(accounts, results, revoked) {
+			log.Print(alert)
+			if admin := t.config().AdminChat; admin != 0 {
+				t.Send(admin, alert, false)
+			}
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,25 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCredentialAlerts(t *testing.T) {
+	accounts := []string{nextcloud.DEFAULT_ACCOUNT, "club"}
+	revoked := map[string]bool{}
+	alerts := credentialAlerts(accounts, map[string]error{nextcloud.DEFAULT_ACCOUNT: nil, "club": nextcloud.ErrRevoked}, revoked)
+	assert.Equal(t, []string{`⚠ - Nextcloud rejects the app password of the account 'club', it was probably revoked. Run "rpgreminder login --account club" and reload the bot.`}, alerts)
+
+	// Still revoked, or not checked because the server was not reachable
+	assert.Empty(t, credentialAlerts(accounts, map[string]error{"club": nextcloud.ErrRevoked}, revoked))
+	assert.Empty(t, credentialAlerts(accounts, map[string]error{}, revoked))
+
+	alerts = credentialAlerts(accounts, map[string]error{nextcloud.DEFAULT_ACCOUNT: nextcloud.ErrRevoked, "club": nil}, revoked)
+	assert.Equal(t, []string{
+		`⚠ - Nextcloud rejects the app password of the account 'nextcloud', it was probably revoked. Run "rpgreminder login" and reload the bot.`,
+		`🤖 - The Nextcloud account 'club' works again.`,
+	}, alerts)
+}
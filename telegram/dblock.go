@@ -0,0 +1,36 @@
+//go:build unix
+
+// This file tells the command line whether a bot is using the database.
+package telegram
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Returned if the database is locked by a running bot
+var ErrDatabaseInUse = errors.New("the database is in use by a running bot")
+
+// Lock the file next to the database. The bot holds a shared lock while it
+// runs, commands that replace the database need an exclusive one. The lock is
+// released when the returned file is closed or the process exits.
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrDatabaseInUse
+		}
+		return nil, err
+	}
+	return file, nil
+}
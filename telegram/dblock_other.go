@@ -0,0 +1,15 @@
+//go:build !unix
+
+package telegram
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrDatabaseInUse = errors.New("the database is in use by a running bot")
+
+// File locks are not supported, a running bot is not detected.
+func lockDatabase(path string, exclusive bool) (*os.File, error) {
+	return os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+}
@@ -0,0 +1,152 @@
+// This file keeps the stored messages in sync with edits and deletions in the chat.
+package telegram
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+)
+
+const MESSAGES_EDITED string = `ALTER TABLE messages ADD COLUMN edited DATETIME`
+const MESSAGES_DELETED string = `ALTER TABLE messages ADD COLUMN deleted DATETIME`
+const EDITS_TABLE string = `CREATE TABLE IF NOT EXISTS message_edits (
+id INTEGER NOT NULL PRIMARY KEY,
+messageId INTEGER NOT NULL,
+date DATETIME NOT NULL,
+text TEXT
+)`
+const EDITS_INDEX string = `CREATE INDEX IF NOT EXISTS message_edits_message ON message_edits (messageId)`
+
+// The edit history is removed together with its message
+const EDITS_TRIGGER string = `CREATE TRIGGER IF NOT EXISTS messages_delete_edits AFTER DELETE ON messages
+BEGIN
+DELETE FROM message_edits WHERE messageId = old.id;
+END`
+const EDIT_LOOKUP string = `SELECT id, text, date, edited FROM messages WHERE channelId = ? AND msgId = ? AND type = 'received'`
+const EDIT_INSERT string = `INSERT INTO message_edits (messageId, date, text) VALUES(?, ?, ?)`
+const EDIT_UPDATE string = `UPDATE messages SET text = ?, edited = ? WHERE id = ?`
+const EDITS_QUERY string = `SELECT id, date, text FROM message_edits WHERE messageId = ? ORDER BY date, id`
+
+// A previous version of a message
+type MessageEdit struct {
+	// When this version was written
+	Date time.Time
+	Text string
+}
+
+func (db *MessageDB) EditMessage(channelId int64, msgId int, text string, edited time.Time) (bool, error) {
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var id int64
+	var previous sql.NullString
+	var previousDate time.Time
+	var previousEdit sql.NullTime
+	err = tx.QueryRow(EDIT_LOOKUP, channelId, msgId).Scan(&id, &previous, &previousDate, &previousEdit)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if previousEdit.Valid {
+		previousDate = previousEdit.Time
+	}
+	// The previous text is encrypted for the message, not for its edit.
+	previousText, err := db.cipher.Decrypt(previous.String, Field{Table: "messages", Column: "text", Row: id})
+	if err != nil {
+		return false, err
+	}
+	// Cleared texts stay NULL, the others are written once the id is known.
+	res, err := tx.Exec(EDIT_INSERT, id, previousDate.UTC(), sql.NullString{Valid: previous.Valid})
+	if err != nil {
+		return false, err
+	}
+	editId, err := res.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+	if previous.Valid {
+		err = db.encryptRow(tx, "message_edits", editId, []string{"text"}, []string{previousText})
+		if err != nil {
+			return false, err
+		}
+	}
+	encrypted, err := db.cipher.Encrypt(text, Field{Table: "messages", Column: "text", Row: id})
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(EDIT_UPDATE, encrypted, edited.UTC(), id)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func (db *MessageDB) Edits(id int64) ([]MessageEdit, error) {
+	rows, err := db.connection.Query(EDITS_QUERY, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	edits := []MessageEdit{}
+	for rows.Next() {
+		var edit MessageEdit
+		var editId int64
+		var text sql.NullString
+		err = rows.Scan(&editId, &edit.Date, &text)
+		if err != nil {
+			return nil, err
+		}
+		edit.Text, err = db.cipher.Decrypt(text.String, Field{Table: "message_edits", Column: "text", Row: editId})
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, edit)
+	}
+	return edits, rows.Err()
+}
+
+func (db *MessageDB) MarkDeleted(ids []int64, deleted time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := []any{deleted.UTC()}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := db.connection.Exec(fmt.Sprintf("UPDATE messages SET deleted = ? WHERE id IN (%s)", placeholders), args...)
+	return err
+}
+
+// Update the stored text of a message that was edited in the chat
+func (t *TelegramBot) StoreEdit(ctx *th.Context, update telego.Update) error {
+	msg := *update.EditedMessage
+	log.Print("Received edited message from chat: ", msg.Chat.ID)
+	if t.FindMapping(msg.Chat.ID).Retention.MetadataOnly {
+		msg.Text = ""
+	}
+	t.lock.Lock()
+	found, err := t.messages.EditMessage(msg.Chat.ID, msg.MessageID, msg.Text, time.Unix(msg.EditDate, 0))
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not store edited message: ", err)
+		return err
+	}
+	if !found {
+		// Messages sent before the bot joined or removed by the retention
+		// policy are stored as new messages, without their content if the
+		// policy says so.
+		return t.storeMessage(update.EditedMessage, RECEIVED)
+	}
+	return nil
+}
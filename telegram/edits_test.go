@@ -0,0 +1,56 @@
+package telegram
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditsAndDeletions(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for _, store := range []MessageStore{db, NewMemoryStore()} {
+		date := time.Unix(1625648400, 0).UTC()
+		msg := &DBMessage{MsgId: 10, ChannelId: 1001, Date: date, User: "anna", Text: "first", Type: RECEIVED}
+		_, err := store.SaveMessage(msg)
+		assert.NoError(t, err)
+
+		found, err := store.EditMessage(1001, 10, "second", date.Add(time.Minute))
+		assert.NoError(t, err)
+		assert.True(t, found)
+		found, err = store.EditMessage(1001, 10, "third", date.Add(2*time.Minute))
+		assert.NoError(t, err)
+		assert.True(t, found)
+		found, err = store.EditMessage(1001, 11, "unknown", date)
+		assert.NoError(t, err)
+		assert.False(t, found)
+
+		received, err := store.ListReceived(1001, time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.Len(t, received, 1)
+		assert.Equal(t, "third", received[0].Text)
+		assert.Equal(t, date.Add(2*time.Minute), received[0].Edited)
+		edits, err := store.Edits(msg.Id)
+		assert.NoError(t, err)
+		assert.Equal(t, []MessageEdit{{date, "first"}, {date.Add(time.Minute), "second"}}, edits)
+
+		assert.NoError(t, store.MarkDeleted([]int64{msg.Id}, date.Add(time.Hour)))
+		count, err := store.Count(1001, MessageFilter{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+		count, err = store.Count(1001, MessageFilter{IncludeDeleted: true})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		// The edit history is removed together with the message
+		assert.NoError(t, store.DeleteByIDs([]int64{msg.Id}))
+		edits, err = store.Edits(msg.Id)
+		assert.NoError(t, err)
+		assert.Empty(t, edits)
+	}
+}
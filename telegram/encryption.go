@@ -0,0 +1,288 @@
+// This file encrypts the stored messages, the send queue and the announced
+// votes at rest.
+package telegram
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variable that holds the base64 encoded key - takes precedence
+// over the key file from the configuration.
+const EncryptionKeyEnv string = "RPGREMINDER_ENCRYPTION_KEY"
+
+// Prefix of encrypted values, followed by the key ID and the ciphertext. The
+// ciphertext is bound to the key, table, column and row of the value.
+const encryptedPrefix string = "enc2:"
+
+// Prefix of values written before they were bound to their row - only read
+const legacyEncryptedPrefix string = "enc:"
+
+type EncryptionConfig struct {
+	// File containing the base64 encoded 32 byte key
+	KeyFile string `json:"key_file"`
+	// Keys used before a rotation - only used to read existing messages
+	PreviousKeyFiles []string `json:"previous_key_files"`
+}
+
+// Where a value is stored. Encrypted values can only be read at the same
+// place, so they can not be copied into another row or column.
+type Field struct {
+	Table  string
+	Column string
+	// The rowid of the row
+	Row int64
+}
+
+func (f Field) additionalData(keyId string) []byte {
+	return []byte(fmt.Sprintf("%s:%s.%s:%d", keyId, f.Table, f.Column, f.Row))
+}
+
+// Encrypts values with AES-GCM. Values are written with the primary key, but
+// can be read with any of the known keys.
+type Cipher struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+func parseKey(encoded string) (string, cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", nil, fmt.Errorf("encryption key is not valid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return "", nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	// The ID only identifies the key, it must not reveal it.
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4]), aead, nil
+}
+
+// Create a cipher from base64 encoded keys, the first key is the primary key
+func NewCipher(primary string, previous ...string) (*Cipher, error) {
+	c := &Cipher{keys: map[string]cipher.AEAD{}}
+	for i, encoded := range append([]string{primary}, previous...) {
+		id, aead, err := parseKey(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			c.primary = id
+		}
+		c.keys[id] = aead
+	}
+	return c, nil
+}
+
+// Load the keys of the configuration. Returns nil if encryption is disabled.
+func LoadCipher(config EncryptionConfig) (*Cipher, error) {
+	primary := os.Getenv(EncryptionKeyEnv)
+	if primary == "" && config.KeyFile != "" {
+		content, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		primary = string(content)
+	}
+	if primary == "" {
+		return nil, nil
+	}
+	previous := []string{}
+	for _, path := range config.PreviousKeyFiles {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, string(content))
+	}
+	return NewCipher(primary, previous...)
+}
+
+// Encrypt the value with the primary key for the field it is stored in. A nil
+// cipher returns the value as is.
+func (c *Cipher) Encrypt(value string, field Field) (string, error) {
+	if c == nil || value == "" {
+		return value, nil
+	}
+	aead := c.keys[c.primary]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), field.additionalData(c.primary))
+	return encryptedPrefix + c.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a value written by Encrypt for the same field. Values stored before
+// encryption was enabled are returned unchanged.
+func (c *Cipher) Decrypt(value string, field Field) (string, error) {
+	prefix := encryptedPrefix
+	if strings.HasPrefix(value, legacyEncryptedPrefix) {
+		prefix = legacyEncryptedPrefix
+	} else if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", fmt.Errorf("message is encrypted but no encryption key is configured")
+	}
+	id, encoded, found := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !found {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	aead, ok := c.keys[id]
+	if !ok {
+		return "", fmt.Errorf("message was encrypted with unknown key %s", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	additionalData := field.additionalData(id)
+	if prefix == legacyEncryptedPrefix {
+		// Only bound to the key - rewritten by reencrypt
+		additionalData = []byte(id)
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Columns that are encrypted by table
+var encryptedColumns = map[string][]string{
+	"messages":      {"user", "text", "caption", "forwardFrom"},
+	"message_edits": {"text"},
+	"sendqueue":     {"text"},
+	"snapshots":     {"data"},
+}
+
+// Store the values of a row that was just inserted with empty values. The
+// values are encrypted for their row, so its id has to be known first.
+func (db *MessageDB) encryptRow(tx *sql.Tx, table string, id int64, columns []string, values []string) error {
+	assignments, args := []string{}, []any{}
+	for i, column := range columns {
+		value, err := db.cipher.Encrypt(values[i], Field{Table: table, Column: column, Row: id})
+		if err != nil {
+			return err
+		}
+		assignments = append(assignments, column+" = ?")
+		args = append(args, value)
+	}
+	_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET %s WHERE rowid = ?", table, strings.Join(assignments, ", ")), append(args, id)...)
+	return err
+}
+
+// Encrypt the user, text and caption of all messages and their edits, the
+// send queue and the snapshots with the primary key of the cipher. Used after
+// a key rotation, to encrypt rows stored before encryption was enabled or to
+// bind values of older versions to their rows. Returns the number of
+// rewritten rows.
+func (db *MessageDB) ReEncrypt(c *Cipher) (int, error) {
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	count := 0
+	for table, columns := range encryptedColumns {
+		rewritten, err := reencryptTable(tx, c, table, columns)
+		if err != nil {
+			return 0, err
+		}
+		count += rewritten
+	}
+	return count, tx.Commit()
+}
+
+// Re-encrypt the database at the path, see ReEncrypt. Fails with
+// ErrDatabaseInUse while a bot uses the database, as the bot would write
+// messages with the old key in the meantime.
+func ReEncryptDatabase(path string, c *Cipher) (int, error) {
+	lock, err := lockDatabase(path, true)
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	db, err := OpenDatabase(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	return db.ReEncrypt(c)
+}
+
+func reencryptTable(tx *sql.Tx, c *Cipher, table string, columns []string) (int, error) {
+	// Not all tables have an id column, but all have a rowid
+	rows, err := tx.Query(fmt.Sprintf("SELECT rowid, %s FROM %s", strings.Join(columns, ", "), table))
+	if err != nil {
+		return 0, err
+	}
+	type row struct {
+		id     int64
+		values []sql.NullString
+	}
+	all := []row{}
+	for rows.Next() {
+		r := row{values: make([]sql.NullString, len(columns))}
+		dest := []any{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		all = append(all, r)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	assignments := []string{}
+	for _, column := range columns {
+		assignments = append(assignments, column+" = ?")
+	}
+	update := fmt.Sprintf("UPDATE %s SET %s WHERE rowid = ?", table, strings.Join(assignments, ", "))
+	for _, r := range all {
+		args := []any{}
+		for i, value := range r.values {
+			field := Field{Table: table, Column: columns[i], Row: r.id}
+			plain, err := c.Decrypt(value.String, field)
+			if err != nil {
+				return 0, fmt.Errorf("%s %d: %w", table, r.id, err)
+			}
+			value.String, err = c.Encrypt(plain, field)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, value)
+		}
+		_, err = tx.Exec(update, append(args, r.id)...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(all), nil
+}
@@ -0,0 +1,191 @@
+package telegram
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	field := Field{Table: "messages", Column: "text", Row: 1}
+
+	encrypted, err := c.Encrypt("the dragon is called Smaug", field)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix))
+	assert.NotContains(t, encrypted, "Smaug")
+
+	decrypted, err := c.Decrypt(encrypted, field)
+	assert.NoError(t, err)
+	assert.Equal(t, "the dragon is called Smaug", decrypted)
+
+	// Values can not be moved to another row or column
+	_, err = c.Decrypt(encrypted, Field{Table: "messages", Column: "text", Row: 2})
+	assert.Error(t, err)
+	_, err = c.Decrypt(encrypted, Field{Table: "messages", Column: "user", Row: 1})
+	assert.Error(t, err)
+
+	// Messages stored before encryption was enabled are still readable
+	plain, err := c.Decrypt("plain text", field)
+	assert.NoError(t, err)
+	assert.Equal(t, "plain text", plain)
+
+	other, err := NewCipher(testKey('b'))
+	assert.NoError(t, err)
+	_, err = other.Decrypt(encrypted, field)
+	assert.ErrorContains(t, err, "unknown key")
+
+	_, err = NewCipher("too short")
+	assert.Error(t, err)
+}
+
+// A value as written before values were bound to their row
+func legacyEncrypt(c *Cipher, value string) string {
+	aead := c.keys[c.primary]
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(c.primary))
+	return legacyEncryptedPrefix + c.primary + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestLegacyCiphertext(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	c, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(c)
+	_, err = db.connection.Exec(INSERT_MESSAGE, 1, 1001, time.Now().UTC(), legacyEncrypt(c, "anna"), legacyEncrypt(c, "secret"), RECEIVED, 0, TEXT_CONTENT, "", "", 0, "")
+	assert.NoError(t, err)
+	received, err := db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "anna", received[0].User)
+	assert.Equal(t, "secret", received[0].Text)
+	db.Close()
+
+	// The bot holds the database, re-encrypting has to wait for it to stop
+	lock, err := lockDatabase(path, false)
+	assert.NoError(t, err)
+	_, err = ReEncryptDatabase(path, c)
+	assert.ErrorIs(t, err, ErrDatabaseInUse)
+	lock.Close()
+	count, err := ReEncryptDatabase(path, c)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	db, err = OpenDatabase(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	db.SetCipher(c)
+	var text string
+	assert.NoError(t, db.connection.QueryRow(`SELECT text FROM messages`).Scan(&text))
+	assert.True(t, strings.HasPrefix(text, encryptedPrefix))
+	received, err = db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", received[0].Text)
+}
+
+func TestReEncrypt(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	old, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(old)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 1, ChannelId: 1001, Date: time.Now(), User: "anna", Text: "secret", Type: RECEIVED})
+	assert.NoError(t, err)
+	edited, err := db.EditMessage(1001, 1, "edited secret", time.Now())
+	assert.NoError(t, err)
+	assert.True(t, edited)
+
+	// Rotate to a new key, the old one is only kept to read existing messages
+	rotated, err := NewCipher(testKey('b'), testKey('a'))
+	assert.NoError(t, err)
+	count, err := db.ReEncrypt(rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	onlyNew, err := NewCipher(testKey('b'))
+	assert.NoError(t, err)
+	db.SetCipher(onlyNew)
+	received, err := db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, received, 1)
+	assert.Equal(t, "anna", received[0].User)
+	assert.Equal(t, "edited secret", received[0].Text)
+	edits, err := db.Edits(received[0].Id)
+	assert.NoError(t, err)
+	assert.Len(t, edits, 1)
+	assert.Equal(t, "secret", edits[0].Text)
+}
+
+func TestEncryptedQueueAndSnapshots(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	// Stored before encryption was enabled
+	assert.NoError(t, db.SaveSnapshot(1002, `{"anna": "yes"}`))
+	c, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(c)
+
+	_, err = db.QueueMessage(1001, "Anna voted yes", false)
+	assert.NoError(t, err)
+	assert.NoError(t, db.SaveSnapshot(1001, `{"anna": "yes"}`))
+	var text, data string
+	assert.NoError(t, db.connection.QueryRow(`SELECT text FROM sendqueue`).Scan(&text))
+	assert.NoError(t, db.connection.QueryRow(`SELECT data FROM snapshots WHERE channelId = 1001`).Scan(&data))
+	assert.NotContains(t, text, "Anna")
+	assert.NotContains(t, data, "anna")
+
+	due, err := db.PendingMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, "Anna voted yes", due[0].Text)
+	for _, channelId := range []int64{1001, 1002} {
+		snapshot, err := db.Snapshot(channelId)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"anna": "yes"}`, snapshot)
+	}
+	count, err := db.ReEncrypt(c)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.NoError(t, db.connection.QueryRow(`SELECT data FROM snapshots WHERE channelId = 1002`).Scan(&data))
+	assert.NotContains(t, data, "anna")
+}
+
+func TestForgetEncryptedUser(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	c, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(c)
+	// Messages stored before user IDs were recorded
+	for i, user := range []string{"anna", "ben", "anna"} {
+		_, err = db.SaveMessage(&DBMessage{MsgId: i + 1, ChannelId: 1001, Date: time.Now(), User: user, Text: "hello", Type: RECEIVED})
+		assert.NoError(t, err)
+	}
+	forgotten, err := db.ForgetUser(1001, 7, "anna")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), forgotten)
+	received, err := db.ListReceived(1001, time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, received, 1)
+	assert.Equal(t, "ben", received[0].User)
+}
@@ -0,0 +1,307 @@
+// This file exports the stored chat log and poll history of a channel.
+package telegram
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+type ExportFormat = string
+
+const EXPORT_JSON ExportFormat = "json"
+const EXPORT_MARKDOWN ExportFormat = "md"
+const EXPORT_CSV ExportFormat = "csv"
+
+var exportFormats = []ExportFormat{EXPORT_JSON, EXPORT_MARKDOWN, EXPORT_CSV}
+
+const OUTBOX_HISTORY string = `SELECT ` + OUTBOX_COLUMNS + ` FROM outbox WHERE channelId = ? ORDER BY id`
+
+const exportTimeFormat string = "2006-01-02 15:04"
+
+type ExportMessage struct {
+	Date        time.Time  `json:"date"`
+	Type        string     `json:"type"`
+	User        string     `json:"user,omitempty"`
+	ContentType string     `json:"content_type"`
+	Text        string     `json:"text,omitempty"`
+	Caption     string     `json:"caption,omitempty"`
+	ReplyTo     int        `json:"reply_to,omitempty"`
+	ForwardFrom string     `json:"forward_from,omitempty"`
+	Edited      *time.Time `json:"edited,omitempty"`
+	Deleted     *time.Time `json:"deleted,omitempty"`
+}
+
+// The votes of an option as they were last seen by the bot
+type ExportOption struct {
+	Date    time.Time         `json:"date"`
+	Yes     int               `json:"yes"`
+	Answers map[string]string `json:"answers"`
+}
+
+// A change the bot made or tried to make to the poll
+type ExportChange struct {
+	Action   OutboxAction `json:"action"`
+	Date     time.Time    `json:"date"`
+	Status   OutboxStatus `json:"status"`
+	Attempts int          `json:"attempts"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type Export struct {
+	ChannelId int64     `json:"channel_id"`
+	PollId    int       `json:"poll_id"`
+	Exported  time.Time `json:"exported"`
+	// The time frame of the export - zero times are not restricted
+	Since    time.Time       `json:"since"`
+	Until    time.Time       `json:"until"`
+	Messages []ExportMessage `json:"messages"`
+	Options  []ExportOption  `json:"options"`
+	Changes  []ExportChange  `json:"changes"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (e *Export) inRange(date time.Time) bool {
+	return (e.Since.IsZero() || !date.Before(e.Since)) && (e.Until.IsZero() || date.Before(e.Until))
+}
+
+// Collect the messages, the last known poll state and the poll changes of the
+// channel in the time frame.
+func (db *MessageDB) Export(channelId int64, pollId int, since time.Time, until time.Time) (*Export, error) {
+	export := &Export{
+		ChannelId: channelId,
+		PollId:    pollId,
+		Exported:  time.Now().UTC(),
+		Since:     since,
+		Until:     until,
+		Messages:  []ExportMessage{},
+		Options:   []ExportOption{},
+		Changes:   []ExportChange{},
+	}
+	messages, err := db.list(channelId, MessageFilter{Since: since, Until: until, IncludeDeleted: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range messages {
+		export.Messages = append(export.Messages, ExportMessage{
+			Date:        msg.Date,
+			Type:        msg.Type,
+			User:        msg.User,
+			ContentType: msg.ContentType,
+			Text:        msg.Text,
+			Caption:     msg.Caption,
+			ReplyTo:     msg.ReplyTo,
+			ForwardFrom: msg.ForwardFrom,
+			Edited:      optionalTime(msg.Edited),
+			Deleted:     optionalTime(msg.Deleted),
+		})
+	}
+
+	data, err := db.Snapshot(channelId)
+	if err != nil {
+		return nil, err
+	}
+	if data != "" {
+		var snapshot nextcloud.Snapshot
+		err = json.Unmarshal([]byte(data), &snapshot)
+		if err != nil {
+			return nil, err
+		}
+		for _, option := range snapshot.Options {
+			date := time.Unix(option.Timestamp, 0).UTC()
+			if export.inRange(date) {
+				export.Options = append(export.Options, ExportOption{Date: date, Yes: option.Yes(), Answers: option.Answers})
+			}
+		}
+		slices.SortFunc(export.Options, func(a ExportOption, b ExportOption) int {
+			return a.Date.Compare(b.Date)
+		})
+	}
+
+	changes, err := db.queryOutbox(OUTBOX_HISTORY, channelId)
+	if err != nil {
+		return nil, err
+	}
+	for _, change := range changes {
+		date := time.Unix(change.Timestamp, 0).UTC()
+		if export.inRange(date) {
+			export.Changes = append(export.Changes, ExportChange{
+				Action:   change.Action,
+				Date:     date,
+				Status:   change.Status,
+				Attempts: change.Attempts,
+				Error:    change.LastError.String,
+			})
+		}
+	}
+	return export, nil
+}
+
+// The name of the exported file, e.g. chat-1001-2026-10-18.json
+func (e *Export) FileName(format ExportFormat) string {
+	return fmt.Sprintf("chat-%d-%s.%s", e.ChannelId, e.Exported.Local().Format(dateFormat), format)
+}
+
+func (e *Export) Write(w io.Writer, format ExportFormat) error {
+	switch format {
+	case EXPORT_JSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(e)
+	case EXPORT_MARKDOWN:
+		_, err := io.WriteString(w, e.markdown())
+		return err
+	case EXPORT_CSV:
+		return e.writeCSV(w)
+	}
+	return fmt.Errorf("unknown export format '%s', use one of %s", format, strings.Join(exportFormats, ", "))
+}
+
+// The text of the message including media and edits
+func (m *ExportMessage) content() string {
+	content := strings.TrimSpace(m.Text + " " + m.Caption)
+	if m.ContentType != TEXT_CONTENT {
+		content = strings.TrimSpace("[" + m.ContentType + "] " + content)
+	}
+	return content
+}
+
+func (m *ExportMessage) notes() []string {
+	notes := []string{}
+	if m.ForwardFrom != "" {
+		notes = append(notes, "forwarded from "+m.ForwardFrom)
+	}
+	if m.ReplyTo != 0 {
+		notes = append(notes, fmt.Sprintf("reply to #%d", m.ReplyTo))
+	}
+	if m.Edited != nil {
+		notes = append(notes, "edited "+m.Edited.Local().Format(exportTimeFormat))
+	}
+	if m.Deleted != nil {
+		notes = append(notes, "deleted "+m.Deleted.Local().Format(exportTimeFormat))
+	}
+	return notes
+}
+
+func (e *Export) markdown() string {
+	lines := []string{fmt.Sprintf("# Chat %d", e.ChannelId), ""}
+	lines = append(lines, fmt.Sprintf("Exported on %s.", e.Exported.Local().Format(exportTimeFormat)), "")
+
+	lines = append(lines, "## Messages", "")
+	for _, msg := range e.Messages {
+		user := msg.User
+		if msg.Type == SENT {
+			user = "bot"
+		}
+		line := fmt.Sprintf("- %s **%s**: %s", msg.Date.Local().Format(exportTimeFormat), user, msg.content())
+		if notes := msg.notes(); len(notes) > 0 {
+			line += " _(" + strings.Join(notes, ", ") + ")_"
+		}
+		lines = append(lines, line)
+	}
+
+	lines = append(lines, "", fmt.Sprintf("## Poll %d", e.PollId), "")
+	users := map[string]bool{}
+	for _, option := range e.Options {
+		for user := range option.Answers {
+			users[user] = true
+		}
+	}
+	names := slices.Sorted(maps.Keys(users))
+	header := append([]string{"Date", "Yes"}, names...)
+	lines = append(lines, "| "+strings.Join(header, " | ")+" |")
+	lines = append(lines, "|"+strings.Repeat("---|", len(header)))
+	for _, option := range e.Options {
+		row := []string{option.Date.Local().Format(exportTimeFormat), strconv.Itoa(option.Yes)}
+		for _, name := range names {
+			row = append(row, option.Answers[name])
+		}
+		lines = append(lines, "| "+strings.Join(row, " | ")+" |")
+	}
+
+	lines = append(lines, "", "## Poll changes", "")
+	for _, change := range e.Changes {
+		line := fmt.Sprintf("- %s %s: %s", change.Action, change.Date.Local().Format(exportTimeFormat), change.Status)
+		if change.Error != "" {
+			line += " (" + change.Error + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Write all records into a single table, the kind column tells whether a
+// row is a message, a vote or a change of the poll.
+func (e *Export) writeCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	records := [][]string{{"kind", "date", "user", "content", "details"}}
+	for _, msg := range e.Messages {
+		records = append(records, []string{msg.Type, msg.Date.Format(time.RFC3339), msg.User, msg.content(), strings.Join(msg.notes(), ", ")})
+	}
+	for _, option := range e.Options {
+		for _, user := range slices.Sorted(maps.Keys(option.Answers)) {
+			records = append(records, []string{"vote", option.Date.Format(time.RFC3339), user, option.Answers[user], ""})
+		}
+	}
+	for _, change := range e.Changes {
+		records = append(records, []string{"change", change.Date.Format(time.RFC3339), "", change.Action, strings.TrimSpace(change.Status + " " + change.Error)})
+	}
+	err := writer.WriteAll(records)
+	if err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+// Send the chat log and poll history as a file to the administrators
+func (t *TelegramBot) Export(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	if update.Message.From == nil || !t.isAdmin(chatId, update.Message.From.ID) {
+		t.Send(chatId, `⚠ - Only administrators of this chat can use /export.`, false)
+		return nil
+	}
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	format, since, until, err := ParseExportArgs(args, time.Now())
+	if err != nil {
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	t.lock.Lock()
+	export, err := t.db.Export(chatId, t.FindPollId(chatId), since, until)
+	t.lock.Unlock()
+	var content bytes.Buffer
+	if err == nil {
+		err = export.Write(&content, format)
+	}
+	if err != nil {
+		log.Print("Could not export chat: ", err)
+		t.Send(chatId, `⚠ - The export could not be created, please try again later.`, false)
+		return nil
+	}
+	_, err = t.bot.SendDocument(context.Background(), tu.Document(tu.ID(chatId), tu.FileFromReader(&content, export.FileName(format))))
+	if err != nil {
+		log.Print("Could not send export: ", err)
+		t.Send(chatId, `⚠ - The export could not be sent, please try again later.`, false)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package telegram
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExport(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	date := time.Date(2026, 10, 10, 18, 0, 0, 0, time.UTC)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 1, ChannelId: 1001, Date: date, User: "anna", Text: "Who brings the dice?", Type: RECEIVED})
+	assert.NoError(t, err)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 2, ChannelId: 1001, Date: date.Add(time.Minute), User: "bob", Type: RECEIVED, ContentType: "photo", Caption: "My dice", ReplyTo: 1})
+	assert.NoError(t, err)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 3, ChannelId: 1001, Date: date.AddDate(0, 0, -30), User: "anna", Text: "Old news", Type: RECEIVED})
+	assert.NoError(t, err)
+	_, err = db.SaveMessage(&DBMessage{MsgId: 4, ChannelId: 1002, Date: date, User: "carl", Text: "Other chat", Type: RECEIVED})
+	assert.NoError(t, err)
+	assert.NoError(t, db.SaveSnapshot(1001, `{"options":{"7":{"timestamp":1792000000,"answers":{"anna":"yes","bob":"no"}}}}`))
+	assert.NoError(t, db.Enqueue(&OutboxEntry{ChannelId: 1001, PollId: 3, Action: CREATE_OPTION, Timestamp: 1792000000, Duration: 0}))
+
+	export, err := db.Export(1001, 3, date.AddDate(0, 0, -7), time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, export.Messages, 2)
+	assert.Equal(t, "My dice", export.Messages[1].Caption)
+	assert.Len(t, export.Options, 1)
+	assert.Equal(t, 1, export.Options[0].Yes)
+	assert.Len(t, export.Changes, 1)
+	assert.Equal(t, PENDING, export.Changes[0].Status)
+
+	var content bytes.Buffer
+	assert.NoError(t, export.Write(&content, EXPORT_JSON))
+	var decoded Export
+	assert.NoError(t, json.Unmarshal(content.Bytes(), &decoded))
+	assert.Equal(t, "Who brings the dice?", decoded.Messages[0].Text)
+	assert.Nil(t, decoded.Messages[0].Deleted)
+
+	content.Reset()
+	assert.NoError(t, export.Write(&content, EXPORT_MARKDOWN))
+	assert.Contains(t, content.String(), "**bob**: [photo] My dice _(reply to #1)_")
+	assert.Contains(t, content.String(), "| Date | Yes | anna | bob |")
+
+	content.Reset()
+	assert.NoError(t, export.Write(&content, EXPORT_CSV))
+	records, err := csv.NewReader(&content).ReadAll()
+	assert.NoError(t, err)
+	// Header, two messages, two votes and one change
+	assert.Len(t, records, 6)
+	assert.Equal(t, []string{"vote", "2026-10-14T17:46:40Z", "anna", "yes", ""}, records[3])
+
+	assert.Error(t, export.Write(&content, "pdf"))
+	assert.Equal(t, "chat-1001-"+export.Exported.Local().Format(dateFormat)+".csv", export.FileName(EXPORT_CSV))
+}
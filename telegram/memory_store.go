@@ -0,0 +1,185 @@
+// This file keeps messages in memory, mostly useful for tests.
+package telegram
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// A MessageStore that does not persist anything
+type MemoryStore struct {
+	lock     sync.Mutex
+	lastId   int64
+	messages []DBMessage
+	edits    map[int64][]MessageEdit
+}
+
+var _ MessageStore = &MemoryStore{}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{edits: map[int64][]MessageEdit{}}
+}
+
+func (m *MemoryStore) SaveMessage(msg *DBMessage) (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastId++
+	msg.Id = m.lastId
+	if msg.ContentType == "" {
+		msg.ContentType = TEXT_CONTENT
+	}
+	m.messages = append(m.messages, *msg)
+	return msg.Id, nil
+}
+
+func (f MessageFilter) matches(channelId int64, msg *DBMessage) bool {
+	return msg.ChannelId == channelId &&
+		(f.Type == "" || msg.Type == f.Type) &&
+		(f.Since.IsZero() || !msg.Date.Before(f.Since)) &&
+		(f.Until.IsZero() || msg.Date.Before(f.Until)) &&
+		(f.IncludeDeleted || msg.Deleted.IsZero())
+}
+
+func (m *MemoryStore) list(channelId int64, filter MessageFilter) []DBMessage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	matching := []DBMessage{}
+	for _, msg := range m.messages {
+		if filter.matches(channelId, &msg) {
+			matching = append(matching, msg)
+		}
+	}
+	slices.SortStableFunc(matching, func(a DBMessage, b DBMessage) int {
+		return a.Date.Compare(b.Date)
+	})
+	if filter.Limit > 0 {
+		start := min(filter.Offset, len(matching))
+		end := min(start+filter.Limit, len(matching))
+		matching = matching[start:end]
+	}
+	return matching
+}
+
+func (m *MemoryStore) ListSent(channelId int64, filter MessageFilter) ([]DBMessage, error) {
+	filter.Type = SENT
+	return m.list(channelId, filter), nil
+}
+
+func (m *MemoryStore) ListReceived(channelId int64, since time.Time, limit int) ([]DBMessage, error) {
+	return m.list(channelId, MessageFilter{Type: RECEIVED, Since: since, Limit: limit}), nil
+}
+
+func (m *MemoryStore) DeleteByIDs(ids []int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.messages = slices.DeleteFunc(m.messages, func(msg DBMessage) bool {
+		return slices.Contains(ids, msg.Id)
+	})
+	for _, id := range ids {
+		delete(m.edits, id)
+	}
+	return nil
+}
+
+func (m *MemoryStore) Count(channelId int64, filter MessageFilter) (int, error) {
+	filter.Limit = 0
+	return len(m.list(channelId, filter)), nil
+}
+
+func (m *MemoryStore) update(apply func(msg *DBMessage) (bool, bool)) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var affected int64
+	kept := m.messages[:0]
+	for _, msg := range m.messages {
+		changed, remove := apply(&msg)
+		if changed || remove {
+			affected++
+		}
+		if remove {
+			delete(m.edits, msg.Id)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	m.messages = kept
+	return affected
+}
+
+func (m *MemoryStore) DeleteBefore(channelId int64, msgType MessageType, before time.Time) (int64, error) {
+	return m.update(func(msg *DBMessage) (bool, bool) {
+		return false, msg.ChannelId == channelId && msg.Type == msgType && msg.Date.Before(before)
+	}), nil
+}
+
+func (m *MemoryStore) ClearText(channelId int64, msgType MessageType) (int64, error) {
+	return m.update(func(msg *DBMessage) (bool, bool) {
+		if msg.ChannelId != channelId || msg.Type != msgType || (msg.Text == "" && msg.Caption == "") {
+			return false, false
+		}
+		msg.Text = ""
+		msg.Caption = ""
+		delete(m.edits, msg.Id)
+		return true, false
+	}), nil
+}
+
+func (m *MemoryStore) ForgetUser(channelId int64, userId int64, user string) (int64, error) {
+	return m.update(func(msg *DBMessage) (bool, bool) {
+		return false, msg.Type == RECEIVED && (msg.UserId == userId || (msg.ChannelId == channelId && msg.UserId == 0 && msg.User == user))
+	}), nil
+}
+
+func (m *MemoryStore) EditMessage(channelId int64, msgId int, text string, edited time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for i := range m.messages {
+		msg := &m.messages[i]
+		if msg.ChannelId != channelId || msg.MsgId != msgId || msg.Type != RECEIVED {
+			continue
+		}
+		previous := msg.Date
+		if !msg.Edited.IsZero() {
+			previous = msg.Edited
+		}
+		m.edits[msg.Id] = append(m.edits[msg.Id], MessageEdit{Date: previous, Text: msg.Text})
+		msg.Text = text
+		msg.Edited = edited
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *MemoryStore) Edits(id int64) ([]MessageEdit, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return slices.Clone(m.edits[id]), nil
+}
+
+func (m *MemoryStore) MarkDeleted(ids []int64, deleted time.Time) error {
+	m.update(func(msg *DBMessage) (bool, bool) {
+		if !slices.Contains(ids, msg.Id) {
+			return false, false
+		}
+		msg.Deleted = deleted
+		return true, false
+	})
+	return nil
+}
+
+func (m *MemoryStore) LastActivity(channelId int64, userId int64) (time.Time, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var last time.Time
+	for _, msg := range m.messages {
+		if msg.ChannelId == channelId && msg.Type == RECEIVED && msg.UserId == userId && msg.Date.After(last) {
+			last = msg.Date
+		}
+	}
+	return last, nil
+}
+
+func (m *MemoryStore) Search(channelId int64, terms []string, limit int) ([]DBMessage, error) {
+	return matchMessages(m.list(channelId, MessageFilter{Type: RECEIVED}), terms, limit), nil
+}
@@ -0,0 +1,126 @@
+// This file upgrades the database schema between versions of the bot.
+package telegram
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+type migration struct {
+	description string
+	statements  []string
+}
+
+// The messages table as created before migrations were introduced. A copy of
+// its own, so changes to the statements the bot uses do not change what the
+// first migration creates.
+const v0Table string = `CREATE TABLE IF NOT EXISTS messages (
+id INTEGER NOT NULL PRIMARY KEY,
+msgId INTEGER NOT NULL,
+channelId INTEGER NOT NULL,
+date DATETIME NOT NULL,
+user TEXT,
+text TEXT,
+type TEXT CHECK (type in ('sent', 'received')) NOT NULL DEFAULT 'received'
+)`
+
+// All schema changes in the order they are applied. The schema version stored
+// in `PRAGMA user_version` is the number of applied migrations, so new
+// migrations must only ever be appended to this list, and the statements of
+// released migrations must not be changed.
+//
+// The first migrations use CREATE TABLE IF NOT EXISTS, as databases created
+// before migrations were introduced may already contain these tables.
+var migrations = []migration{
+	{"create messages table", []string{v0Table}},
+	{"create pinned table", []string{PINNED_TABLE}},
+	{"create snapshots table", []string{SNAPSHOT_TABLE}},
+	{"create outbox table", []string{OUTBOX_TABLE}},
+	{"create sendqueue table", []string{SENDQUEUE_TABLE}},
+	{"index messages by channel, type and date", []string{MESSAGES_INDEX}},
+	{"store the user ID of messages", []string{MESSAGES_USER_ID}},
+	{"track edited and deleted messages", []string{MESSAGES_EDITED, MESSAGES_DELETED, EDITS_TABLE, EDITS_INDEX, EDITS_TRIGGER}},
+	{"store media and reply metadata", MESSAGES_CONTENT},
+	{"store the nextcloud account of poll changes", []string{OUTBOX_ACCOUNT}},
+	{pollBindingsMigration, []string{POLL_BINDINGS_TABLE}},
+	{"queue /extendpoll and /cleanup while the poll is unreachable", OUTBOX_PLANS},
+}
+
+// The schema version that applied the migration with the description - 0 if
+// there is none
+func migrationVersion(description string) int {
+	for i, m := range migrations {
+		if m.description == description {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// The schema version of the database at the path, without migrating it
+func DatabaseSchemaVersion(path string) (int, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return SchemaVersion(conn)
+}
+
+// The schema version this binary expects
+func LatestSchemaVersion() int {
+	return len(migrations)
+}
+
+func SchemaVersion(conn *sql.DB) (int, error) {
+	var version int
+	err := conn.QueryRow(`PRAGMA user_version`).Scan(&version)
+	return version, err
+}
+
+// Apply all migrations that are missing in the database, each one in its own
+// transaction. Databases written by a newer version of the bot are refused.
+func Migrate(conn *sql.DB) error {
+	version, err := SchemaVersion(conn)
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d - please upgrade the bot", version, LatestSchemaVersion())
+	}
+	for i, m := range migrations[version:] {
+		target := version + i + 1
+		log.Print("Migrating database to version ", target, ": ", m.description)
+		err = applyMigration(conn, target, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %w", target, m.description, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(conn *sql.DB, target int, m migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, statement := range m.statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	// PRAGMA does not support parameters, target is always a plain integer.
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, target))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
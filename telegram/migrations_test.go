@@ -0,0 +1,63 @@
+package telegram
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// How messages were stored before migrations existed
+const v0Insert string = `INSERT INTO messages VALUES(NULL, ?, ?, ?, ?, ?, ?)`
+
+func TestMigrateFromInitialSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	// A database as created before migrations existed
+	_, err = db.Exec(v0Table)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	_, err = db.Exec(v0Insert, 1, 1001, time.Unix(1625648400, 0).UTC(), "user1", "msg1", RECEIVED)
+	if err != nil {
+		t.Fatalf("Failed to insert message: %v", err)
+	}
+	db.Close()
+
+	messages, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to migrate database: %v", err)
+	}
+	version, err := SchemaVersion(messages.connection)
+	assert.NoError(t, err)
+	assert.Equal(t, LatestSchemaVersion(), version)
+
+	var count int
+	err = messages.connection.QueryRow("SELECT count(*) FROM messages").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Running the migrations again does not change anything
+	assert.NoError(t, Migrate(messages.connection))
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = db.Exec("PRAGMA user_version = 1000")
+	if err != nil {
+		t.Fatalf("Failed to set user_version: %v", err)
+	}
+	db.Close()
+
+	_, err = OpenDatabase(path)
+	assert.ErrorContains(t, err, "newer than the supported version")
+}
@@ -0,0 +1,259 @@
+// This file watches the polls for changes and notifies the channels about them.
+package telegram
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+)
+
+// Default seconds the votes must be stable before a notice is posted
+const defaultDebounce int = 120
+
+// The poll state of a channel while it is watched
+type pollWatch struct {
+	// The poll the state belongs to
+	poll pollKey
+	// Last state that was announced to the channel
+	announced *nextcloud.Snapshot
+	// Last state that was seen in the poll
+	seen nextcloud.Snapshot
+	// When the seen state changed the last time
+	changed time.Time
+}
+
+// Poll IDs are only unique within a Nextcloud account
+type pollKey struct {
+	account string
+	pollId  int
+}
+
+func (k pollKey) matches(mapping ChannelPollMapping) bool {
+	return k.account == mapping.Account && k.pollId == mapping.PollId
+}
+
+// Check the polls of all channels for changes and announce them.
+//
+// Polls are checked every PollInterval seconds and, if enabled, whenever the
+// watch endpoint of Nextcloud reports a change. Notices are only posted once
+// the votes did not change for the debounce time of the channel, so a user
+// clicking through the poll only results in a single notice. The announced
+// state is stored in the database, so changes that happen while the bot is
+// not running are announced after a restart.
+func (t *TelegramBot) WatchPolls() {
+	if t.config().PollInterval <= 0 && !t.config().Watch {
+		log.Print("Poll watching is disabled.")
+		return
+	}
+	watches := map[int64]*pollWatch{}
+	// Check the channels of the poll or all channels if poll is nil
+	check := func(poll *pollKey) {
+		for _, mapping := range t.mappings() {
+			if poll != nil && !poll.matches(mapping) {
+				continue
+			}
+			watch, ok := watches[mapping.ChannelId]
+			if !ok || !watch.poll.matches(mapping) {
+				// The chat uses another poll now, e.g. after /newpoll.
+				watch = &pollWatch{poll: pollKey{account: mapping.Account, pollId: mapping.PollId}}
+				watches[mapping.ChannelId] = watch
+			}
+			err := t.checkPoll(mapping, watch, time.Now())
+			if err != nil {
+				log.Print("Could not check poll ", mapping.PollId, " for changes: ", err)
+			}
+		}
+	}
+	var ticks <-chan time.Time
+	if t.config().PollInterval > 0 {
+		ticker := time.NewTicker(time.Duration(t.config().PollInterval) * time.Second)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var events <-chan nextcloud.PollEvent
+	stopWatching := func() {}
+	// Subscribe to the polls the chats use right now
+	watch := func() {
+		stopWatching()
+		ctx, cancel := context.WithCancel(context.Background())
+		stopWatching = cancel
+		events = t.nextcloud.Watch(ctx, t.pollIds())
+	}
+	if t.config().Watch {
+		watch()
+	}
+	// Changes reported by the watch endpoint are checked again once the
+	// debounce time passed, so they are announced without waiting for a tick.
+	rechecks := make(chan pollKey)
+	scheduled := map[pollKey]bool{}
+	check(nil)
+	for {
+		select {
+		case <-ticks:
+			check(nil)
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			log.Print("Poll ", event.PollId, " changed: ", event.Table)
+			poll := pollKey{account: event.Account, pollId: event.PollId}
+			check(&poll)
+			if !scheduled[poll] {
+				scheduled[poll] = true
+				time.AfterFunc(t.maxDebounce(poll)+time.Second, func() {
+					rechecks <- poll
+				})
+			}
+		case poll := <-rechecks:
+			delete(scheduled, poll)
+			check(&poll)
+		case <-t.remapped:
+			if t.config().Watch {
+				log.Print("The polls of the chats changed, watching them again")
+				watch()
+			}
+		}
+	}
+}
+
+// All polls that are mapped to a channel by account
+func (t *TelegramBot) pollIds() map[string][]int {
+	ids := map[string][]int{}
+	for _, mapping := range t.mappings() {
+		if !slices.Contains(ids[mapping.Account], mapping.PollId) {
+			ids[mapping.Account] = append(ids[mapping.Account], mapping.PollId)
+		}
+	}
+	return ids
+}
+
+// The longest debounce time of all channels using the poll
+func (t *TelegramBot) maxDebounce(poll pollKey) time.Duration {
+	longest := 0
+	for _, mapping := range t.mappings() {
+		if poll.matches(mapping) {
+			longest = max(longest, debounceSeconds(mapping))
+		}
+	}
+	return time.Duration(longest) * time.Second
+}
+
+func debounceSeconds(mapping ChannelPollMapping) int {
+	if mapping.Debounce <= 0 {
+		return defaultDebounce
+	}
+	return mapping.Debounce
+}
+
+func (t *TelegramBot) checkPoll(mapping ChannelPollMapping, watch *pollWatch, now time.Time) error {
+	if watch.announced == nil {
+		announced, err := t.loadSnapshot(mapping.ChannelId)
+		if err != nil {
+			return err
+		}
+		watch.announced = announced
+	}
+	client, err := t.nextcloud.Client(mapping.Account)
+	if err != nil {
+		return err
+	}
+	// Always ask the server, unchanged responses are cheap due to their ETag.
+	client.Invalidate(mapping.PollId)
+	options, err := client.LoadPoll(mapping.PollId)
+	if err != nil {
+		return err
+	}
+	votes, err := client.Votes(mapping.PollId)
+	if err != nil {
+		return err
+	}
+	current := nextcloud.TakeSnapshot(options, votes)
+	if !current.Equal(watch.seen) {
+		if !watch.changed.IsZero() {
+			// The pinned schedule is updated right away, only the notices wait.
+			err = t.UpdatePinned(mapping.ChannelId, ScheduleTable(nextcloud.NextWeekend(options)))
+			if err != nil {
+				log.Print("Could not update pinned schedule: ", err)
+			}
+		}
+		watch.seen = current
+		watch.changed = now
+	}
+	if watch.announced == nil {
+		// First time this channel is watched - nothing to compare against.
+		return t.announce(mapping, watch, nil)
+	}
+	debounce := time.Duration(debounceSeconds(mapping)) * time.Second
+	if watch.announced.Equal(watch.seen) || now.Sub(watch.changed) < debounce {
+		return nil
+	}
+	changes := nextcloud.DiffSnapshots(*watch.announced, watch.seen, mapping.Quorum)
+	return t.announce(mapping, watch, changes)
+}
+
+// Post the changes to the channel and remember the seen state as announced
+func (t *TelegramBot) announce(mapping ChannelPollMapping, watch *pollWatch, changes []nextcloud.Change) error {
+	if len(changes) > 0 && mapping.Notify {
+		notices := []string{}
+		for _, change := range changes {
+			notices = append(notices, FormatChange(change))
+		}
+		t.Send(mapping.ChannelId, "🤖 - "+strings.Join(notices, "\n"), false)
+	}
+	announced := watch.seen
+	watch.announced = &announced
+	return t.storeSnapshot(mapping.ChannelId, announced)
+}
+
+// Describe a change in a single line, e.g. "Anna switched Sat 14/11 to yes"
+func FormatChange(change nextcloud.Change) string {
+	date := time.Unix(change.Timestamp, 0).Format("Mon 02/01")
+	switch change.Type {
+	case nextcloud.VOTE_CHANGED:
+		if change.Answer == "" {
+			return fmt.Sprintf("%s removed the vote for %s", change.User, date)
+		}
+		return fmt.Sprintf("%s switched %s to %s", change.User, date, change.Answer)
+	case nextcloud.QUORUM_REACHED:
+		return fmt.Sprintf("%s now has quorum", date)
+	case nextcloud.QUORUM_LOST:
+		return fmt.Sprintf("%s lost its quorum", date)
+	case nextcloud.OPTION_ADDED:
+		return fmt.Sprintf("%s was added to the poll", date)
+	case nextcloud.OPTION_REMOVED:
+		return fmt.Sprintf("%s was removed from the poll", date)
+	}
+	return fmt.Sprintf("%s changed", date)
+}
+
+func (t *TelegramBot) loadSnapshot(channelId int64) (*nextcloud.Snapshot, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	data, err := t.db.Snapshot(channelId)
+	if err != nil || data == "" {
+		return nil, err
+	}
+	var snapshot nextcloud.Snapshot
+	err = json.Unmarshal([]byte(data), &snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+func (t *TelegramBot) storeSnapshot(channelId int64, snapshot nextcloud.Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.db.SaveSnapshot(channelId, string(data))
+}
@@ -0,0 +1,444 @@
+// This file queues changes to the polls until Nextcloud accepted them.
+package telegram
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+type OutboxAction = string
+
+const CREATE_OPTION OutboxAction = "create"
+const DELETE_OPTION OutboxAction = "delete"
+
+// Add weekends to the poll - planned when the poll can be loaded
+const EXTEND_POLL OutboxAction = "extend"
+
+// Remove the dates before the timestamp - planned when the poll can be loaded
+const CLEANUP_POLL OutboxAction = "cleanup"
+
+type OutboxStatus = string
+
+const PENDING OutboxStatus = "pending"
+const APPLIED OutboxStatus = "applied"
+const FAILED OutboxStatus = "failed"
+const CANCELLED OutboxStatus = "cancelled"
+
+// Seconds between two checks of the outbox
+const outboxInterval time.Duration = 30 * time.Second
+
+// Changes are given up after this many attempts - roughly two days
+const maxOutboxAttempts int = 50
+
+// A change that is being applied is not picked up again for this time, so
+// the bot and the command line do not apply it twice. Longer than any
+// request takes.
+const outboxLease time.Duration = 15 * time.Minute
+
+// Rebuilds the outbox table, as SQLite cannot change the allowed actions of
+// an existing table
+var OUTBOX_PLANS = []string{
+	`CREATE TABLE outbox_new (
+id INTEGER NOT NULL PRIMARY KEY,
+channelId INTEGER NOT NULL,
+account TEXT NOT NULL DEFAULT '',
+pollId INTEGER NOT NULL,
+action TEXT CHECK (action in ('create', 'delete', 'extend', 'cleanup')) NOT NULL,
+optionId INTEGER NOT NULL DEFAULT 0,
+timestamp INTEGER NOT NULL,
+duration INTEGER NOT NULL DEFAULT 0,
+weekends INTEGER NOT NULL DEFAULT 0,
+status TEXT CHECK (status in ('pending', 'applied', 'failed', 'cancelled')) NOT NULL DEFAULT 'pending',
+attempts INTEGER NOT NULL DEFAULT 0,
+nextAttempt DATETIME NOT NULL,
+lastError TEXT
+)`,
+	`INSERT INTO outbox_new (id, channelId, account, pollId, action, optionId, timestamp, duration, status, attempts, nextAttempt, lastError)
+SELECT id, channelId, account, pollId, action, optionId, timestamp, duration, status, attempts, nextAttempt, lastError FROM outbox`,
+	`DROP TABLE outbox`,
+	`ALTER TABLE outbox_new RENAME TO outbox`,
+}
+
+const OUTBOX_INSERT string = `INSERT INTO outbox (channelId, account, pollId, action, optionId, timestamp, duration, weekends, nextAttempt) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)`
+const OUTBOX_COLUMNS string = `id, channelId, account, pollId, action, optionId, timestamp, duration, weekends, status, attempts, nextAttempt, lastError`
+const OUTBOX_PENDING string = `SELECT ` + OUTBOX_COLUMNS + ` FROM outbox WHERE status = 'pending' AND channelId = ? ORDER BY id`
+const OUTBOX_DUE string = `SELECT ` + OUTBOX_COLUMNS + ` FROM outbox WHERE status = 'pending' AND nextAttempt <= ? ORDER BY id`
+const OUTBOX_CLAIM string = `UPDATE outbox SET nextAttempt = ? WHERE id = ? AND status = 'pending' AND nextAttempt <= ?`
+const OUTBOX_UPDATE string = `UPDATE outbox SET status = ?, attempts = ?, nextAttempt = ?, lastError = ? WHERE id = ?`
+const OUTBOX_CANCEL string = `UPDATE outbox SET status = 'cancelled' WHERE status = 'pending' AND channelId = ? AND id = ?`
+const OUTBOX_CANCEL_ALL string = `UPDATE outbox SET status = 'cancelled' WHERE status = 'pending' AND channelId = ?`
+
+// A change to a poll that is applied to Nextcloud
+type OutboxEntry struct {
+	Id        int64
+	ChannelId int64
+	// The Nextcloud account of the poll, so the change is applied to the
+	// same server even if the chat was moved to another account since
+	Account string
+	PollId  int
+	Action  OutboxAction
+	// The option to delete
+	OptionId int
+	// Start and duration of the option to create
+	Timestamp int64
+	Duration  int
+	// The weekends to add to the poll
+	Weekends    int
+	Status      OutboxStatus
+	Attempts    int
+	NextAttempt time.Time
+	LastError   sql.NullString
+	// The outcome of the changes that were planned - not stored
+	Summary string
+}
+
+// Describe the change, e.g. "add Fri 13/11"
+func (e *OutboxEntry) String() string {
+	date := time.Unix(e.Timestamp, 0).Format("Mon 02/01")
+	switch e.Action {
+	case DELETE_OPTION:
+		return "remove " + date
+	case EXTEND_POLL:
+		return fmt.Sprintf("add %d weekends", e.Weekends)
+	case CLEANUP_POLL:
+		return "remove the dates before " + date
+	}
+	return "add " + date
+}
+
+// The exponent is capped, as a larger shift overflows to a negative delay.
+// 2^7 intervals are already more than the hour the delay is limited to.
+func outboxBackoff(attempts int) time.Duration {
+	return min(outboxInterval<<min(attempts, 7), time.Hour)
+}
+
+// Store the change - it is claimed by the caller, which is expected to apply
+// it right away.
+func (db *MessageDB) Enqueue(entry *OutboxEntry) error {
+	entry.Status = PENDING
+	entry.NextAttempt = time.Now().Add(outboxLease).UTC()
+	res, err := db.connection.Exec(OUTBOX_INSERT, entry.ChannelId, entry.Account, entry.PollId, entry.Action, entry.OptionId, entry.Timestamp, entry.Duration, entry.Weekends, entry.NextAttempt)
+	if err != nil {
+		return err
+	}
+	entry.Id, err = res.LastInsertId()
+	return err
+}
+
+func (db *MessageDB) queryOutbox(query string, args ...any) ([]OutboxEntry, error) {
+	rows, err := db.connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		var e OutboxEntry
+		err = rows.Scan(&e.Id, &e.ChannelId, &e.Account, &e.PollId, &e.Action, &e.OptionId, &e.Timestamp, &e.Duration, &e.Weekends, &e.Status, &e.Attempts, &e.NextAttempt, &e.LastError)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// All changes of the channel that were not applied yet
+func (db *MessageDB) PendingChanges(channelId int64) ([]OutboxEntry, error) {
+	return db.queryOutbox(OUTBOX_PENDING, channelId)
+}
+
+// All pending changes that should be attempted again
+func (db *MessageDB) DueChanges(now time.Time) ([]OutboxEntry, error) {
+	return db.queryOutbox(OUTBOX_DUE, now.UTC())
+}
+
+// Mark a due change as being applied. Returns false if it was claimed by
+// someone else since it was loaded.
+func (db *MessageDB) ClaimChange(entry *OutboxEntry, now time.Time) (bool, error) {
+	claimed, err := db.execAffected(OUTBOX_CLAIM, now.Add(outboxLease).UTC(), entry.Id, now.UTC())
+	return claimed == 1, err
+}
+
+func (db *MessageDB) UpdateChange(entry *OutboxEntry) error {
+	_, err := db.connection.Exec(OUTBOX_UPDATE, entry.Status, entry.Attempts, entry.NextAttempt.UTC(), entry.LastError, entry.Id)
+	return err
+}
+
+// Cancel a pending change of the channel - an id of 0 cancels all of them
+func (db *MessageDB) CancelChange(channelId int64, id int64) (int64, error) {
+	var res sql.Result
+	var err error
+	if id == 0 {
+		res, err = db.connection.Exec(OUTBOX_CANCEL_ALL, channelId)
+	} else {
+		res, err = db.connection.Exec(OUTBOX_CANCEL, channelId, id)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// Applies changes to the polls and records their outcome. Shared by the bot
+// and the command line.
+type Outbox struct {
+	// Guards the database
+	lock      *sync.Mutex
+	db        *MessageDB
+	nextcloud *nextcloud.Pool
+}
+
+func NewOutbox(db *MessageDB, nextcloud *nextcloud.Pool) *Outbox {
+	return &Outbox{lock: &sync.Mutex{}, db: db, nextcloud: nextcloud}
+}
+
+// Try to apply the change to Nextcloud and record the outcome. A change for
+// an account that is no longer configured is retried, as the account may be
+// added again by reloading the configuration.
+func (o *Outbox) apply(entry *OutboxEntry) {
+	client, err := o.nextcloud.Client(entry.Account)
+	if err == nil {
+		switch entry.Action {
+		case CREATE_OPTION:
+			err = client.CreateOption(entry.PollId, &nextcloud.PollOptionCreate{Timestamp: entry.Timestamp, Duration: entry.Duration})
+		case DELETE_OPTION:
+			err = client.DeleteOption(&nextcloud.PollOption{Id: entry.OptionId, PollId: entry.PollId})
+		case EXTEND_POLL, CLEANUP_POLL:
+			err = o.plan(client, entry)
+		}
+	}
+	entry.Attempts++
+	var statusErr *nextcloud.StatusError
+	switch {
+	case err == nil:
+		entry.Status = APPLIED
+		entry.LastError = sql.NullString{}
+	case entry.Action == DELETE_OPTION && errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound:
+		// Someone else already removed the option.
+		entry.Status = APPLIED
+		entry.LastError = sql.NullString{}
+	case errors.As(err, &statusErr) && statusErr.Permanent(), entry.Attempts >= maxOutboxAttempts:
+		entry.Status = FAILED
+		entry.LastError = sql.NullString{String: err.Error(), Valid: true}
+	default:
+		entry.NextAttempt = time.Now().Add(outboxBackoff(entry.Attempts))
+		entry.LastError = sql.NullString{String: err.Error(), Valid: true}
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	err = o.db.UpdateChange(entry)
+	if err != nil {
+		log.Print("Could not update outbox entry ", entry.Id, ": ", err)
+	}
+}
+
+// Plan the changes of a command that was queued because its poll could not be
+// loaded, and queue them in turn.
+func (o *Outbox) plan(client *nextcloud.Nextcloud, entry *OutboxEntry) error {
+	client.Invalidate(entry.PollId)
+	poll, err := client.LoadPoll(entry.PollId)
+	if err != nil {
+		return err
+	}
+	mapping := ChannelPollMapping{ChannelId: entry.ChannelId, Account: entry.Account, PollId: entry.PollId}
+	var changes []OutboxEntry
+	if entry.Action == EXTEND_POLL {
+		changes = o.planExtend(poll, mapping, entry.Weekends)
+	} else {
+		changes = PlanCleanup(poll, mapping, time.Unix(entry.Timestamp, 0))
+	}
+	entry.Summary = o.Queue(changes)
+	return nil
+}
+
+// Store the changes in the outbox and try to apply them right away. Returns a
+// summary for the requester that tells which changes are still pending.
+func (o *Outbox) Queue(entries []OutboxEntry) string {
+	applied, pending, failed, planned := 0, []string{}, []string{}, []string{}
+	for i := range entries {
+		entry := &entries[i]
+		o.lock.Lock()
+		err := o.db.Enqueue(entry)
+		o.lock.Unlock()
+		if err != nil {
+			log.Print("Could not queue change: ", err)
+			failed = append(failed, entry.String())
+			continue
+		}
+		o.apply(entry)
+		switch entry.Status {
+		case APPLIED:
+			applied++
+			if entry.Summary != "" {
+				planned = append(planned, entry.Summary)
+			}
+		case FAILED:
+			failed = append(failed, entry.String())
+		default:
+			pending = append(pending, fmt.Sprintf("#%d %s", entry.Id, entry.String()))
+		}
+	}
+	summary := append([]string{fmt.Sprintf("%d of %d changes were applied.", applied, len(entries))}, planned...)
+	if len(pending) > 0 {
+		summary = append(summary, "These could not be applied yet and are retried (see /pending): "+strings.Join(pending, ", "))
+	}
+	if len(failed) > 0 {
+		summary = append(summary, "⚠ - These failed: "+strings.Join(failed, ", "))
+	}
+	return strings.Join(summary, "\n")
+}
+
+// The changes that remove the options of the poll before the given time
+func PlanCleanup(poll *nextcloud.PollOptions, mapping ChannelPollMapping, before time.Time) []OutboxEntry {
+	changes := []OutboxEntry{}
+	for _, opt := range nextcloud.DeleteOptionsBefore(poll, before) {
+		changes = append(changes, OutboxEntry{ChannelId: mapping.ChannelId, Account: mapping.Account, PollId: mapping.PollId, Action: DELETE_OPTION, OptionId: opt.Id, Timestamp: opt.Timestamp})
+	}
+	return changes
+}
+
+// The changes that add the given number of weekends to the end of the poll
+func PlanExtend(poll *nextcloud.PollOptions, mapping ChannelPollMapping, weekends int) []OutboxEntry {
+	changes := []OutboxEntry{}
+	for _, opt := range nextcloud.AddNewOptions(poll, weekends) {
+		changes = append(changes, OutboxEntry{ChannelId: mapping.ChannelId, Account: mapping.Account, PollId: mapping.PollId, Action: CREATE_OPTION, Timestamp: opt.Timestamp, Duration: opt.Duration})
+	}
+	return changes
+}
+
+// Plan the new weekends without the options that are still waiting to be
+// created, e.g. by an earlier /extendpoll while the server was down.
+func (o *Outbox) planExtend(poll *nextcloud.PollOptions, mapping ChannelPollMapping, weekends int) []OutboxEntry {
+	changes := PlanExtend(poll, mapping, weekends)
+	o.lock.Lock()
+	pending, err := o.db.PendingChanges(mapping.ChannelId)
+	o.lock.Unlock()
+	if err != nil {
+		log.Print("Could not load the pending changes of ", mapping.ChannelId, ": ", err)
+		return changes
+	}
+	return withoutPending(changes, pending)
+}
+
+// Drop the options that a pending change already creates
+func withoutPending(changes []OutboxEntry, pending []OutboxEntry) []OutboxEntry {
+	remaining := []OutboxEntry{}
+	for _, change := range changes {
+		queued := slices.ContainsFunc(pending, func(p OutboxEntry) bool {
+			return p.Action == CREATE_OPTION && p.PollId == change.PollId && p.Timestamp == change.Timestamp
+		})
+		if !queued {
+			remaining = append(remaining, change)
+		}
+	}
+	return remaining
+}
+
+// Retry the pending changes periodically and report their outcome.
+func (t *TelegramBot) ProcessOutbox() {
+	ticker := time.NewTicker(outboxInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.lock.Lock()
+		entries, err := t.db.DueChanges(time.Now())
+		t.lock.Unlock()
+		if err != nil {
+			log.Print("Could not load the outbox: ", err)
+			continue
+		}
+		changed := map[int64]bool{}
+		for i := range entries {
+			entry := &entries[i]
+			t.lock.Lock()
+			claimed, err := t.db.ClaimChange(entry, time.Now())
+			t.lock.Unlock()
+			if err != nil {
+				log.Print("Could not claim outbox entry ", entry.Id, ": ", err)
+			}
+			if !claimed {
+				continue
+			}
+			t.outbox.apply(entry)
+			switch entry.Status {
+			case APPLIED:
+				message := fmt.Sprintf("🤖 - Pending change #%d was applied: %s", entry.Id, entry.String())
+				if entry.Summary != "" {
+					message += "\n" + entry.Summary
+				}
+				t.Send(entry.ChannelId, message, false)
+				changed[entry.ChannelId] = true
+			case FAILED:
+				t.Send(entry.ChannelId, fmt.Sprintf("⚠ - Pending change #%d was given up: %s - %s", entry.Id, entry.String(), entry.LastError.String), false)
+			}
+		}
+		for channelId := range changed {
+			t.refreshPinned(channelId)
+		}
+	}
+}
+
+// List the pending changes of the chat or cancel them
+func (t *TelegramBot) Pending(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	if len(args) > 0 {
+		if args[0] != "cancel" || len(args) != 2 {
+			t.SendUsageError(chatId, fmt.Errorf("use /pending, /pending cancel <id> or /pending cancel all"))
+			return nil
+		}
+		var id int64
+		if args[1] != "all" {
+			parsed, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+			if err != nil {
+				t.SendUsageError(chatId, fmt.Errorf("'%s' is not the id of a pending change", args[1]))
+				return nil
+			}
+			id = parsed
+		}
+		t.lock.Lock()
+		cancelled, err := t.db.CancelChange(chatId, id)
+		t.lock.Unlock()
+		if err != nil {
+			log.Print("Could not cancel pending changes: ", err)
+			return err
+		}
+		t.Send(chatId, fmt.Sprintf("🤖 - %d pending changes were cancelled.", cancelled), false)
+		return nil
+	}
+	t.lock.Lock()
+	entries, err := t.db.PendingChanges(chatId)
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not load pending changes: ", err)
+		return err
+	}
+	if len(entries) == 0 {
+		t.Send(chatId, "🤖 - No changes are pending.", false)
+		return nil
+	}
+	lines := []string{"🤖 - These changes are pending:"}
+	for _, entry := range entries {
+		line := fmt.Sprintf("#%d %s - %d attempts, next at %s", entry.Id, entry.String(), entry.Attempts, entry.NextAttempt.Local().Format("02/01 15:04"))
+		if entry.LastError.Valid {
+			line += " (" + entry.LastError.String + ")"
+		}
+		lines = append(lines, line)
+	}
+	lines = append(lines, "Use /pending cancel <id> or /pending cancel all to drop them.")
+	t.Send(chatId, strings.Join(lines, "\n"), false)
+	return nil
+}
@@ -0,0 +1,105 @@
+package telegram
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanExtendSkipsPending(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	outbox := NewOutbox(db, nextcloud.NewPool(nil))
+	mapping := ChannelPollMapping{ChannelId: 1001, PollId: 1}
+	poll := &nextcloud.PollOptions{}
+
+	planned := outbox.planExtend(poll, mapping, 2)
+	assert.NotEmpty(t, planned)
+	for i := range planned {
+		assert.NoError(t, db.Enqueue(&planned[i]))
+	}
+	// The same dates are not queued a second time
+	assert.Empty(t, outbox.planExtend(poll, mapping, 2))
+	more := outbox.planExtend(poll, mapping, 3)
+	assert.Len(t, more, len(PlanExtend(poll, mapping, 3))-len(planned))
+
+	// Other polls are planned on their own
+	assert.Len(t, outbox.planExtend(poll, ChannelPollMapping{ChannelId: 1001, PollId: 2}, 2), len(planned))
+}
+
+func TestOutbox(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+
+	first := OutboxEntry{ChannelId: 1001, PollId: 1, Action: CREATE_OPTION, Timestamp: 1763074800, Duration: 86400}
+	second := OutboxEntry{ChannelId: 1001, Account: "club", PollId: 1, Action: DELETE_OPTION, OptionId: 5, Timestamp: 1760000000}
+	assert.NoError(t, db.Enqueue(&first))
+	assert.NoError(t, db.Enqueue(&second))
+
+	// Queued changes are applied by the caller, not picked up by others
+	due, err := db.DueChanges(time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, due)
+	due, err = db.DueChanges(time.Now().Add(outboxLease))
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	claimed, err := db.ClaimChange(&due[1], time.Now().Add(outboxLease))
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = db.ClaimChange(&due[1], time.Now().Add(outboxLease))
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+
+	first.Attempts = 1
+	first.NextAttempt = time.Now()
+	assert.NoError(t, db.UpdateChange(&first))
+	second.NextAttempt = time.Now()
+	assert.NoError(t, db.UpdateChange(&second))
+	due, err = db.DueChanges(time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, due, 2)
+	assert.Equal(t, second.Id, due[1].Id)
+	assert.Equal(t, "club", due[1].Account)
+
+	cancelled, err := db.CancelChange(1001, second.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), cancelled)
+	pending, err := db.PendingChanges(1001)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 1)
+	assert.Equal(t, "add "+time.Unix(1763074800, 0).Format("Mon 02/01"), pending[0].String())
+
+	// Commands that could not load the poll are planned later
+	extend := OutboxEntry{ChannelId: 1002, PollId: 1, Action: EXTEND_POLL, Weekends: 4}
+	cleanup := OutboxEntry{ChannelId: 1002, PollId: 1, Action: CLEANUP_POLL, Timestamp: 1763074800}
+	assert.NoError(t, db.Enqueue(&extend))
+	assert.NoError(t, db.Enqueue(&cleanup))
+	pending, err = db.PendingChanges(1002)
+	assert.NoError(t, err)
+	assert.Len(t, pending, 2)
+	assert.Equal(t, 4, pending[0].Weekends)
+	assert.Equal(t, "add 4 weekends", pending[0].String())
+	assert.Equal(t, "remove the dates before "+time.Unix(1763074800, 0).Format("Mon 02/01"), pending[1].String())
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	assert.Equal(t, outboxInterval, outboxBackoff(0))
+	assert.Equal(t, 4*outboxInterval, outboxBackoff(2))
+	total := time.Duration(0)
+	for attempts := 1; attempts < maxOutboxAttempts; attempts++ {
+		assert.Greater(t, outboxBackoff(attempts), time.Duration(0))
+		assert.LessOrEqual(t, outboxBackoff(attempts), time.Hour)
+		total += outboxBackoff(attempts)
+	}
+	assert.Equal(t, time.Hour, outboxBackoff(29))
+	assert.Equal(t, time.Hour, outboxBackoff(1000))
+	// Changes are given up after roughly two days
+	assert.InDelta(t, 48*time.Hour, total, float64(8*time.Hour))
+}
@@ -3,6 +3,10 @@ package telegram
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -11,13 +15,28 @@ import (
 type MessageType = string
 
 type DBMessage struct {
-	Id        *int
-	MsgId     *int
-	ChannelId *int64
-	Date      *time.Time
-	User      *string
-	Text      *string
-	Type      *MessageType
+	Id        int64
+	MsgId     int
+	ChannelId int64
+	Date      time.Time
+	User      string
+	Text      string
+	Type      MessageType
+	// Telegram ID of the author - 0 for messages stored before it was recorded
+	UserId int64
+	// When the message was last edited or deleted - zero if it never was
+	Edited  time.Time
+	Deleted time.Time
+	// What the message contains, e.g. text, photo, sticker or poll
+	ContentType string
+	// Caption of media, the question of a poll or the emoji of a sticker
+	Caption string
+	// Telegram file ID of the media
+	FileId string
+	// Message ID of the message this one replies to - 0 if it is no reply
+	ReplyTo int
+	// Who the message was forwarded from - empty if it was not forwarded
+	ForwardFrom string
 }
 
 const SENT MessageType = "sent"
@@ -32,46 +51,436 @@ user TEXT,
 text TEXT,
 type TEXT CHECK (type in ('sent', 'received')) NOT NULL DEFAULT 'received'
 )`
+const PINNED_TABLE string = `CREATE TABLE IF NOT EXISTS pinned (
+channelId INTEGER NOT NULL PRIMARY KEY,
+msgId INTEGER NOT NULL
+)`
+const SNAPSHOT_TABLE string = `CREATE TABLE IF NOT EXISTS snapshots (
+channelId INTEGER NOT NULL PRIMARY KEY,
+data TEXT NOT NULL
+)`
+const OUTBOX_TABLE string = `CREATE TABLE IF NOT EXISTS outbox (
+id INTEGER NOT NULL PRIMARY KEY,
+channelId INTEGER NOT NULL,
+pollId INTEGER NOT NULL,
+action TEXT CHECK (action in ('create', 'delete')) NOT NULL,
+optionId INTEGER NOT NULL DEFAULT 0,
+timestamp INTEGER NOT NULL,
+duration INTEGER NOT NULL DEFAULT 0,
+status TEXT CHECK (status in ('pending', 'applied', 'failed', 'cancelled')) NOT NULL DEFAULT 'pending',
+attempts INTEGER NOT NULL DEFAULT 0,
+nextAttempt DATETIME NOT NULL,
+lastError TEXT
+)`
+const SENDQUEUE_TABLE string = `CREATE TABLE IF NOT EXISTS sendqueue (
+id INTEGER NOT NULL PRIMARY KEY,
+channelId INTEGER NOT NULL,
+text TEXT NOT NULL,
+markdown INTEGER NOT NULL DEFAULT 0,
+status TEXT CHECK (status in ('pending', 'failed')) NOT NULL DEFAULT 'pending',
+attempts INTEGER NOT NULL DEFAULT 0,
+nextAttempt DATETIME NOT NULL,
+lastError TEXT
+)`
+const MESSAGES_INDEX string = `CREATE INDEX IF NOT EXISTS messages_channel_type_date ON messages (channelId, type, date)`
+const MESSAGES_USER_ID string = `ALTER TABLE messages ADD COLUMN userId INTEGER`
+const OUTBOX_ACCOUNT string = `ALTER TABLE outbox ADD COLUMN account TEXT NOT NULL DEFAULT ''`
+const POLL_BINDINGS_TABLE string = `CREATE TABLE IF NOT EXISTS pollbindings (
+channelId INTEGER NOT NULL PRIMARY KEY,
+account TEXT NOT NULL,
+configuredPollId INTEGER NOT NULL,
+pollId INTEGER NOT NULL
+)`
 const INSERT string = `INSERT INTO messages VALUES(NULL, ?, ?, ?, ?, ?, ?)`
+const INSERT_MESSAGE string = `INSERT INTO messages (msgId, channelId, date, user, text, type, userId, contentType, caption, fileId, replyTo, forwardFrom) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 const DELETE string = `DELETE FROM messages WHERE id = ?`
-const SENT_QUERY string = `SELECT * FROM messages WHERE type = 'sent' AND channelId = ?`
-const RECEIVED_QUERY string = `SELECT * FROM messages WHERE type = 'received' AND channelId = ?`
+const MESSAGE_COLUMNS string = `id, msgId, channelId, date, user, text, type, userId, edited, deleted, contentType, caption, fileId, replyTo, forwardFrom`
+const DELETE_BEFORE string = `DELETE FROM messages WHERE channelId = ? AND type = ? AND date < ?`
+const CLEAR_TEXT string = `UPDATE messages SET text = NULL, caption = NULL WHERE channelId = ? AND type = ? AND (text IS NOT NULL OR caption IS NOT NULL)`
+const CLEAR_EDITS string = `DELETE FROM message_edits WHERE messageId IN (SELECT id FROM messages WHERE channelId = ? AND type = ?)`
+const FORGET_USER string = `DELETE FROM messages WHERE type = 'received' AND userId = ?`
+const UNKNOWN_USERS string = `SELECT id, user FROM messages WHERE type = 'received' AND channelId = ? AND coalesce(userId, 0) = 0`
+const PINNED_QUERY string = `SELECT msgId FROM pinned WHERE channelId = ?`
+const PINNED_UPSERT string = `INSERT OR REPLACE INTO pinned VALUES(?, ?)`
+const LAST_ACTIVITY string = `SELECT date FROM messages WHERE channelId = ? AND type = 'received' AND userId = ? ORDER BY date DESC LIMIT 1`
+const SNAPSHOT_QUERY string = `SELECT data FROM snapshots WHERE channelId = ?`
+const SNAPSHOT_UPSERT string = `INSERT OR REPLACE INTO snapshots VALUES(?, ?)`
+const SNAPSHOT_DELETE string = `DELETE FROM snapshots WHERE channelId = ?`
+const POLL_BINDINGS_QUERY string = `SELECT channelId, account, configuredPollId, pollId FROM pollbindings ORDER BY channelId`
+const POLL_BINDINGS_UPSERT string = `INSERT OR REPLACE INTO pollbindings VALUES(?, ?, ?, ?)`
+
+// Restricts which messages of a channel are returned. Zero values do not
+// restrict anything.
+type MessageFilter struct {
+	Type  MessageType
+	Since time.Time
+	Until time.Time
+	// Also return messages that were deleted from the chat
+	IncludeDeleted bool
+	// Page through the results with Limit and Offset
+	Limit  int
+	Offset int
+}
+
+// Access to the stored messages of all channels
+type MessageStore interface {
+	SaveMessage(msg *DBMessage) (int64, error)
+	ListSent(channelId int64, filter MessageFilter) ([]DBMessage, error)
+	ListReceived(channelId int64, since time.Time, limit int) ([]DBMessage, error)
+	DeleteByIDs(ids []int64) error
+	Count(channelId int64, filter MessageFilter) (int, error)
+	// Remove messages of the type that are older than before
+	DeleteBefore(channelId int64, msgType MessageType, before time.Time) (int64, error)
+	// Keep only the metadata of messages of the type
+	ClearText(channelId int64, msgType MessageType) (int64, error)
+	// Remove all received messages of a user in all channels. Messages stored
+	// without a user ID are matched by the user name, but only in the channel
+	// the user asked in, as names are neither unique nor permanent.
+	ForgetUser(channelId int64, userId int64, user string) (int64, error)
+	// Replace the text of a message and keep the previous text in its edit
+	// history. Returns false if the message is not stored.
+	EditMessage(channelId int64, msgId int, text string, edited time.Time) (bool, error)
+	// The previous versions of a message, oldest first
+	Edits(id int64) ([]MessageEdit, error)
+	// Received messages that contain words starting with every term, best
+	// matches first
+	Search(channelId int64, terms []string, limit int) ([]DBMessage, error)
+	// When the user last wrote a message in the channel - zero if never
+	LastActivity(channelId int64, userId int64) (time.Time, error)
+	// Record that the messages were removed from the chat
+	MarkDeleted(ids []int64, deleted time.Time) error
+}
 
 type MessageDB struct {
-	connection                     *sql.DB
-	insert, delete, sent, received *sql.Stmt
+	connection *sql.DB
+	// Encrypts the user and text of messages - nil stores them in plaintext
+	cipher *Cipher
+	// Whether the FTS5 search index is available
+	search bool
 }
 
+var _ MessageStore = &MessageDB{}
+
 func OpenDatabase(dbPath string) (*MessageDB, error) {
 	conn, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
 	}
-	_, err = conn.Exec(TABLE)
+	err = Migrate(conn)
 	if err != nil {
 		return nil, err
 	}
-	ins, err := conn.Prepare(INSERT)
+	db := &MessageDB{connection: conn}
+	err = db.setupSearchIndex()
 	if err != nil {
 		return nil, err
 	}
-	del, err := conn.Prepare(DELETE)
+	return db, nil
+}
+
+// Open the database at the path for reading, without migrating it - for the
+// command line, which must not change the database of the running bot.
+func OpenReadOnly(dbPath string) (*MessageDB, error) {
+	_, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return &MessageDB{connection: conn}, nil
+}
+
+// Open the configured database and enable the encryption of messages
+func OpenStore(config *TelegramConfig) (*MessageDB, error) {
+	db, err := OpenDatabase(config.Database)
+	if err != nil {
+		return nil, fmt.Errorf("could not open database path at %s: %w", config.Database, err)
+	}
+	cipher, err := LoadCipher(config.Encryption)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not load the encryption key: %w", err)
+	}
+	db.SetCipher(cipher)
+	return db, nil
+}
+
+// Open the configured database for the command line without migrating it, as
+// a running bot may still use the old schema. Fails unless the database has
+// the schema of this binary.
+func OpenExisting(config *TelegramConfig) (*MessageDB, error) {
+	_, err := os.Stat(config.Database)
 	if err != nil {
 		return nil, err
 	}
-	sent, err := conn.Prepare(SENT_QUERY)
+	conn, err := sql.Open("sqlite3", config.Database)
 	if err != nil {
 		return nil, err
 	}
-	received, err := conn.Prepare(RECEIVED_QUERY)
+	db := &MessageDB{connection: conn}
+	version, err := SchemaVersion(conn)
+	if err == nil && version < LatestSchemaVersion() {
+		err = fmt.Errorf("database schema version %d is older than version %d - stop the bot and run rpgreminder migrate first", version, LatestSchemaVersion())
+	} else if err == nil && version > LatestSchemaVersion() {
+		err = fmt.Errorf("database schema version %d is newer than the supported version %d - please upgrade", version, LatestSchemaVersion())
+	}
+	if err == nil {
+		// The bot already set up the search index.
+		err = conn.QueryRow(FTS5_AVAILABLE).Scan(&db.search)
+	}
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
-	return &MessageDB{
-		connection: conn,
-		insert:     ins,
-		delete:     del,
-		sent:       sent,
-		received:   received,
-	}, nil
+	cipher, err := LoadCipher(config.Encryption)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not load the encryption key: %w", err)
+	}
+	db.SetCipher(cipher)
+	return db, nil
+}
+
+func (db *MessageDB) SetCipher(c *Cipher) {
+	db.cipher = c
+}
+
+func (db *MessageDB) Close() error {
+	return db.connection.Close()
+}
+
+func (db *MessageDB) SaveMessage(msg *DBMessage) (int64, error) {
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = TEXT_CONTENT
+	}
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(INSERT_MESSAGE, msg.MsgId, msg.ChannelId, msg.Date.UTC(), "", "", msg.Type, msg.UserId,
+		contentType, "", msg.FileId, msg.ReplyTo, "")
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	// Everything that identifies a person or contains what they wrote
+	err = db.encryptRow(tx, "messages", id, encryptedColumns["messages"], []string{msg.User, msg.Text, msg.Caption, msg.ForwardFrom})
+	if err != nil {
+		return 0, err
+	}
+	msg.Id = id
+	return msg.Id, tx.Commit()
+}
+
+// Build the WHERE clause for the filter
+func (f MessageFilter) where(channelId int64) (string, []any) {
+	conditions := []string{"channelId = ?"}
+	args := []any{channelId}
+	if f.Type != "" {
+		conditions = append(conditions, "type = ?")
+		args = append(args, f.Type)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "date >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "date < ?")
+		args = append(args, f.Until.UTC())
+	}
+	if !f.IncludeDeleted {
+		conditions = append(conditions, "deleted IS NULL")
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+func (db *MessageDB) list(channelId int64, filter MessageFilter) ([]DBMessage, error) {
+	where, args := filter.where(channelId)
+	query := "SELECT " + MESSAGE_COLUMNS + " FROM messages" + where + " ORDER BY date, id"
+	if filter.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, filter.Limit, filter.Offset)
+	}
+	return db.query(query, args...)
+}
+
+// Run a query that selects MESSAGE_COLUMNS and decrypt the results
+func (db *MessageDB) query(query string, args ...any) ([]DBMessage, error) {
+	rows, err := db.connection.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []DBMessage{}
+	for rows.Next() {
+		var msg DBMessage
+		var user, text, caption, fileId, forwardFrom sql.NullString
+		var userId, replyTo sql.NullInt64
+		var edited, deleted sql.NullTime
+		err = rows.Scan(&msg.Id, &msg.MsgId, &msg.ChannelId, &msg.Date, &user, &text, &msg.Type, &userId, &edited, &deleted,
+			&msg.ContentType, &caption, &fileId, &replyTo, &forwardFrom)
+		if err != nil {
+			return nil, err
+		}
+		decrypted := []*string{&msg.User, &msg.Text, &msg.Caption, &msg.ForwardFrom}
+		for i, value := range []sql.NullString{user, text, caption, forwardFrom} {
+			*decrypted[i], err = db.cipher.Decrypt(value.String, Field{Table: "messages", Column: encryptedColumns["messages"][i], Row: msg.Id})
+			if err != nil {
+				return nil, err
+			}
+		}
+		msg.UserId = userId.Int64
+		msg.Edited = edited.Time
+		msg.Deleted = deleted.Time
+		msg.FileId = fileId.String
+		msg.ReplyTo = int(replyTo.Int64)
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// Messages the bot sent to the channel, oldest first
+func (db *MessageDB) ListSent(channelId int64, filter MessageFilter) ([]DBMessage, error) {
+	filter.Type = SENT
+	return db.list(channelId, filter)
+}
+
+// Messages the bot received in the channel since the given time, oldest first
+func (db *MessageDB) ListReceived(channelId int64, since time.Time, limit int) ([]DBMessage, error) {
+	return db.list(channelId, MessageFilter{Type: RECEIVED, Since: since, Limit: limit})
+}
+
+func (db *MessageDB) DeleteByIDs(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	args := make([]any, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := db.connection.Exec(fmt.Sprintf("DELETE FROM messages WHERE id IN (%s)", placeholders), args...)
+	return err
+}
+
+func (db *MessageDB) Count(channelId int64, filter MessageFilter) (int, error) {
+	where, args := filter.where(channelId)
+	var count int
+	err := db.connection.QueryRow("SELECT count(*) FROM messages"+where, args...).Scan(&count)
+	return count, err
+}
+
+func (db *MessageDB) DeleteBefore(channelId int64, msgType MessageType, before time.Time) (int64, error) {
+	return db.execAffected(DELETE_BEFORE, channelId, msgType, before.UTC())
+}
+
+func (db *MessageDB) ClearText(channelId int64, msgType MessageType) (int64, error) {
+	_, err := db.connection.Exec(CLEAR_EDITS, channelId, msgType)
+	if err != nil {
+		return 0, err
+	}
+	return db.execAffected(CLEAR_TEXT, channelId, msgType)
+}
+
+func (db *MessageDB) ForgetUser(channelId int64, userId int64, user string) (int64, error) {
+	// Encrypted names differ on every write, so they are compared decrypted.
+	rows, err := db.connection.Query(UNKNOWN_USERS, channelId)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		var name sql.NullString
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return 0, err
+		}
+		name.String, err = db.cipher.Decrypt(name.String, Field{Table: "messages", Column: "user", Row: id})
+		if err != nil {
+			return 0, err
+		}
+		if name.String == user {
+			ids = append(ids, id)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	err = db.DeleteByIDs(ids)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := db.execAffected(FORGET_USER, userId)
+	return removed + int64(len(ids)), err
+}
+
+func (db *MessageDB) LastActivity(channelId int64, userId int64) (time.Time, error) {
+	var date time.Time
+	err := db.connection.QueryRow(LAST_ACTIVITY, channelId, userId).Scan(&date)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return date, err
+}
+
+func (db *MessageDB) execAffected(query string, args ...any) (int64, error) {
+	res, err := db.connection.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// The message that shows the live schedule of a channel - 0 if there is none
+func (db *MessageDB) PinnedMessage(channelId int64) (int, error) {
+	var msgId int
+	err := db.connection.QueryRow(PINNED_QUERY, channelId).Scan(&msgId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return msgId, err
+}
+
+func (db *MessageDB) SetPinnedMessage(channelId int64, msgId int) error {
+	_, err := db.connection.Exec(PINNED_UPSERT, channelId, msgId)
+	return err
+}
+
+// The last poll state that was announced in a channel - empty if there is none
+func (db *MessageDB) Snapshot(channelId int64) (string, error) {
+	var data string
+	err := db.connection.QueryRow(SNAPSHOT_QUERY, channelId).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return db.cipher.Decrypt(data, Field{Table: "snapshots", Column: "data", Row: channelId})
+}
+
+func (db *MessageDB) DeleteSnapshot(channelId int64) error {
+	_, err := db.connection.Exec(SNAPSHOT_DELETE, channelId)
+	return err
+}
+
+// Store the announced votes - encrypted, as they contain the names of voters
+func (db *MessageDB) SaveSnapshot(channelId int64, data string) error {
+	// The channel is the rowid of the snapshot.
+	data, err := db.cipher.Encrypt(data, Field{Table: "snapshots", Column: "data", Row: channelId})
+	if err != nil {
+		return err
+	}
+	_, err = db.connection.Exec(SNAPSHOT_UPSERT, channelId, data)
+	return err
 }
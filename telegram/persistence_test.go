@@ -2,6 +2,7 @@ package telegram
 
 import (
 	"database/sql"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -242,3 +243,101 @@ func TestQueryMessages(t *testing.T) {
 
 	assert.Equal(t, expectedMsgs, actualMsgs)
 }
+
+// Both stores have to behave the same
+func testMessageStore(t *testing.T, store MessageStore) {
+	base := time.Unix(1625648400, 0).UTC()
+	for i, msgType := range []MessageType{SENT, RECEIVED, SENT, RECEIVED, SENT} {
+		_, err := store.SaveMessage(&DBMessage{
+			MsgId:     i + 1,
+			ChannelId: 1001,
+			Date:      base.Add(time.Duration(i) * time.Minute),
+			User:      "user",
+			Text:      "msg",
+			Type:      msgType,
+		})
+		assert.NoError(t, err)
+	}
+	_, err := store.SaveMessage(&DBMessage{MsgId: 1, ChannelId: 1002, Date: base, Type: SENT})
+	assert.NoError(t, err)
+
+	sent, err := store.ListSent(1001, MessageFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, sent, 3)
+	assert.Equal(t, []int{1, 3, 5}, []int{sent[0].MsgId, sent[1].MsgId, sent[2].MsgId})
+
+	page, err := store.ListSent(1001, MessageFilter{Limit: 2, Offset: 2})
+	assert.NoError(t, err)
+	assert.Len(t, page, 1)
+	assert.Equal(t, 5, page[0].MsgId)
+
+	received, err := store.ListReceived(1001, base.Add(2*time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, received, 1)
+	assert.Equal(t, 4, received[0].MsgId)
+	assert.Equal(t, base.Add(3*time.Minute), received[0].Date)
+
+	count, err := store.Count(1001, MessageFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	assert.NoError(t, store.DeleteByIDs([]int64{sent[0].Id, sent[1].Id}))
+	count, err = store.Count(1001, MessageFilter{Type: SENT})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = store.Count(1002, MessageFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	last, err := store.LastActivity(1001, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, base.Add(3*time.Minute), last.UTC())
+	last, err = store.LastActivity(1001, 42)
+	assert.NoError(t, err)
+	assert.True(t, last.IsZero())
+}
+
+func TestMessageDBStore(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	testMessageStore(t, db)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMessageStore(t, NewMemoryStore())
+}
+
+func TestOpenExisting(t *testing.T) {
+	config := &TelegramConfig{Database: filepath.Join(t.TempDir(), "messages.db")}
+	// A missing database is not created
+	_, err := OpenExisting(config)
+	assert.Error(t, err)
+	conn, err := sql.Open("sqlite3", config.Database)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	_, err = conn.Exec(v0Table)
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	conn.Close()
+
+	// An old schema is left for the bot to migrate
+	_, err = OpenExisting(config)
+	assert.ErrorContains(t, err, "run rpgreminder migrate first")
+	version, err := DatabaseSchemaVersion(config.Database)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	migrated, err := OpenDatabase(config.Database)
+	assert.NoError(t, err)
+	migrated.Close()
+	db, err := OpenExisting(config)
+	assert.NoError(t, err)
+	defer db.Close()
+	_, err = db.QueueMessage(1001, "hello", false)
+	assert.NoError(t, err)
+}
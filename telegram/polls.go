@@ -0,0 +1,288 @@
+// This file creates, closes and archives polls from the chat.
+package telegram
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// The Polls app rejects longer titles
+const maxPollTitle int = 128
+
+const pollBindingsMigration string = "bind chats to polls created with /newpoll"
+
+// The schema version that added the pollbindings table
+var pollBindingsVersion = migrationVersion(pollBindingsMigration)
+
+// Settings of the polls created with /newpoll
+type NewPollConfig struct {
+	// "private" (default) only lets invited users and the share link vote,
+	// "open" all users of the Nextcloud server
+	Access nextcloud.PollAccess `json:"access"`
+	// Hide who voted what from the other participants
+	Anonymous bool `json:"anonymous"`
+	// Weekends the poll starts with - 0 uses the default of /extendpoll
+	Weekends int `json:"weekends"`
+}
+
+func (c NewPollConfig) weekends() int {
+	if c.Weekends <= 0 {
+		return DefaultExtendWeekends
+	}
+	return c.Weekends
+}
+
+func (c NewPollConfig) update() nextcloud.PollUpdate {
+	update := nextcloud.PollUpdate{Access: c.Access}
+	if update.Access == "" {
+		update.Access = nextcloud.ACCESS_PRIVATE
+	}
+	if c.Anonymous {
+		update.Anonymous = 1
+	}
+	return update
+}
+
+func (c NewPollConfig) validate(path string) error {
+	errs := []error{}
+	if c.Access != "" && c.Access != nextcloud.ACCESS_PRIVATE && c.Access != nextcloud.ACCESS_OPEN {
+		errs = append(errs, fmt.Errorf("%s.access must be %s or %s", path, nextcloud.ACCESS_PRIVATE, nextcloud.ACCESS_OPEN))
+	}
+	if c.Weekends < 0 || c.Weekends > maxExtendWeekends {
+		errs = append(errs, fmt.Errorf("%s.weekends must be between 0 and %d", path, maxExtendWeekends))
+	}
+	return errors.Join(errs...)
+}
+
+// A poll created with /newpoll that the chat uses instead of the configured
+// one. It only applies while the configuration still names the poll it
+// replaced, so changing pollid in the configuration takes precedence.
+type PollBinding struct {
+	ChannelId        int64
+	Account          string
+	ConfiguredPollId int
+	PollId           int
+}
+
+// The chats with the polls they use
+func ApplyPollBindings(mappings []ChannelPollMapping, bindings map[int64]PollBinding) []ChannelPollMapping {
+	applied := make([]ChannelPollMapping, len(mappings))
+	for i, mapping := range mappings {
+		binding, ok := bindings[mapping.ChannelId]
+		if ok && binding.Account == mapping.Account && binding.ConfiguredPollId == mapping.PollId {
+			mapping.PollId = binding.PollId
+		}
+		applied[i] = mapping
+	}
+	return applied
+}
+
+func queryPollBindings(conn *sql.DB) (map[int64]PollBinding, error) {
+	rows, err := conn.Query(POLL_BINDINGS_QUERY)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bindings := map[int64]PollBinding{}
+	for rows.Next() {
+		var binding PollBinding
+		err = rows.Scan(&binding.ChannelId, &binding.Account, &binding.ConfiguredPollId, &binding.PollId)
+		if err != nil {
+			return nil, err
+		}
+		bindings[binding.ChannelId] = binding
+	}
+	return bindings, rows.Err()
+}
+
+func (db *MessageDB) PollBindings() (map[int64]PollBinding, error) {
+	return queryPollBindings(db.connection)
+}
+
+// Bind the chat to the poll. The announced state of the previous poll is
+// dropped, so its options are not reported as removed.
+func (db *MessageDB) BindPoll(binding PollBinding) error {
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(POLL_BINDINGS_UPSERT, binding.ChannelId, binding.Account, binding.ConfiguredPollId, binding.PollId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(SNAPSHOT_DELETE, binding.ChannelId)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// The bindings of the database at the path, without migrating it - for the
+// command line, which must not change the database of the running bot.
+func ReadPollBindings(path string) (map[int64]PollBinding, error) {
+	version, err := DatabaseSchemaVersion(path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && version < pollBindingsVersion) {
+		return map[int64]PollBinding{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return queryPollBindings(conn)
+}
+
+// The configured chats with the polls they currently use
+func (t *TelegramBot) mappings() []ChannelPollMapping {
+	t.configLock.RLock()
+	defer t.configLock.RUnlock()
+	return ApplyPollBindings(t.configuration.ChannelsToPolls, t.bindings)
+}
+
+// Use the poll in the chat from now on
+func (t *TelegramBot) bindPoll(channelId int64, pollId int) error {
+	configured := ChannelPollMapping{}
+	for _, mapping := range t.config().ChannelsToPolls {
+		if mapping.ChannelId == channelId {
+			configured = mapping
+		}
+	}
+	binding := PollBinding{ChannelId: channelId, Account: configured.Account, ConfiguredPollId: configured.PollId, PollId: pollId}
+	t.lock.Lock()
+	err := t.db.BindPoll(binding)
+	t.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	t.configLock.Lock()
+	t.bindings[channelId] = binding
+	t.configLock.Unlock()
+	t.mappingsChanged()
+	return nil
+}
+
+// Parse the arguments of /newpoll and return the title
+func parseNewPollArgs(args []string) (string, error) {
+	title := strings.Join(args, " ")
+	if title == "" {
+		return "", errors.New("/newpoll needs a title, e.g. /newpoll Season 3")
+	}
+	if utf8.RuneCountInString(title) > maxPollTitle {
+		return "", fmt.Errorf("the title must not be longer than %d characters", maxPollTitle)
+	}
+	return title, nil
+}
+
+// The configuration of the chat and the client of its account, if the user
+// may manage the poll. Otherwise the chat is told why not.
+func (t *TelegramBot) pollAdmin(update telego.Update, command string) (ChannelPollMapping, *nextcloud.Nextcloud, bool) {
+	chatId := update.Message.Chat.ID
+	if update.Message.From == nil || !t.isAdmin(chatId, update.Message.From.ID) {
+		t.Send(chatId, fmt.Sprintf(`⚠ - Only administrators of this chat can use /%s.`, command), false)
+		return ChannelPollMapping{}, nil, false
+	}
+	mapping := t.FindMapping(chatId)
+	if mapping.ChannelId == 0 {
+		t.Send(chatId, `⚠ - This chat is not configured, add it to telegram.channels first.`, false)
+		return mapping, nil, false
+	}
+	client, err := t.nextcloud.Client(mapping.Account)
+	if err != nil {
+		log.Print("Could not use the Nextcloud account of ", chatId, ": ", err)
+		t.Send(chatId, `⚠ - The Nextcloud account of this chat is not configured.`, false)
+		return mapping, nil, false
+	}
+	return mapping, client, true
+}
+
+// Create a new poll, start it with the next weekends and use it in the chat
+func (t *TelegramBot) NewPoll(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	title, err := parseNewPollArgs(args)
+	if err != nil {
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	mapping, client, ok := t.pollAdmin(update, "newpoll")
+	if !ok {
+		return nil
+	}
+	poll, err := client.CreatePoll(title)
+	if err != nil {
+		log.Print("Could not create poll: ", err)
+		t.Send(chatId, `⚠ - The poll could not be created, please try again later.`, false)
+		return nil
+	}
+	lines := []string{fmt.Sprintf(`🤖 - Created the poll "%s", this chat uses it from now on.`, title)}
+	err = client.UpdatePoll(poll.Id, mapping.NewPoll.update())
+	if err != nil {
+		log.Print("Could not change the settings of poll ", poll.Id, ": ", err)
+		lines = append(lines, "⚠ - Its access settings could not be changed, please check them in Nextcloud.")
+	}
+	err = t.bindPoll(chatId, poll.Id)
+	if err != nil {
+		log.Print("Could not bind poll ", poll.Id, " to ", chatId, ": ", err)
+		t.Send(chatId, fmt.Sprintf(`⚠ - The poll %d was created, but this chat could not be switched to it.`, poll.Id), false)
+		return nil
+	}
+	link, err := client.SharePoll(poll.Id)
+	if err != nil {
+		log.Print("Could not share poll ", poll.Id, ": ", err)
+	} else {
+		lines = append(lines, "Vote here: "+link)
+	}
+	mapping.PollId = poll.Id
+	changes := PlanExtend(&nextcloud.PollOptions{}, mapping, mapping.NewPoll.weekends())
+	lines = append(lines, fmt.Sprintf("Adding %d weekends to the poll.", mapping.NewPoll.weekends()), t.outbox.Queue(changes))
+	t.Send(chatId, strings.Join(lines, "\n"), false)
+	t.refreshPinned(chatId)
+	return nil
+}
+
+// Stop accepting votes in the poll of the chat
+func (t *TelegramBot) ClosePoll(ctx *th.Context, update telego.Update) error {
+	mapping, client, ok := t.pollAdmin(update, "closepoll")
+	if !ok {
+		return nil
+	}
+	err := client.ClosePoll(mapping.PollId, time.Now())
+	if err != nil {
+		log.Print("Could not close poll ", mapping.PollId, ": ", err)
+		t.Send(mapping.ChannelId, `⚠ - The poll could not be closed, please try again later.`, false)
+		return nil
+	}
+	t.Send(mapping.ChannelId, `🤖 - The poll is closed, no more votes are accepted.`, false)
+	return nil
+}
+
+// Move the poll of the chat to the archive at the end of a season
+func (t *TelegramBot) ArchivePoll(ctx *th.Context, update telego.Update) error {
+	mapping, client, ok := t.pollAdmin(update, "archivepoll")
+	if !ok {
+		return nil
+	}
+	err := client.ArchivePoll(mapping.PollId)
+	if err != nil {
+		log.Print("Could not archive poll ", mapping.PollId, ": ", err)
+		t.Send(mapping.ChannelId, `⚠ - The poll could not be archived, please try again later.`, false)
+		return nil
+	}
+	t.Send(mapping.ChannelId, `🤖 - The poll was archived. Start the next season with /newpoll <title>.`, false)
+	return nil
+}
@@ -0,0 +1,69 @@
+package telegram
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPollBindings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	bindings, err := ReadPollBindings(path)
+	assert.NoError(t, err)
+	assert.Empty(t, bindings)
+
+	db, err := OpenDatabase(path)
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.SaveSnapshot(1, `{}`))
+	assert.NoError(t, db.BindPoll(PollBinding{ChannelId: 1, Account: "club", ConfiguredPollId: 3, PollId: 9}))
+	snapshot, err := db.Snapshot(1)
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot)
+
+	bindings, err = ReadPollBindings(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int64]PollBinding{1: {ChannelId: 1, Account: "club", ConfiguredPollId: 3, PollId: 9}}, bindings)
+	mappings := []ChannelPollMapping{
+		{ChannelId: 1, PollId: 3, Account: "club"},
+		{ChannelId: 2, PollId: 3, Account: "club"},
+	}
+	assert.Equal(t, []ChannelPollMapping{
+		{ChannelId: 1, PollId: 9, Account: "club"},
+		{ChannelId: 2, PollId: 3, Account: "club"},
+	}, ApplyPollBindings(mappings, bindings))
+	// Another poll in the configuration wins over the binding
+	assert.Equal(t, 4, ApplyPollBindings([]ChannelPollMapping{{ChannelId: 1, PollId: 4, Account: "club"}}, bindings)[0].PollId)
+	assert.Equal(t, 11, pollBindingsVersion)
+	assert.Contains(t, migrations[pollBindingsVersion-1].statements, POLL_BINDINGS_TABLE)
+
+	assert.NoError(t, db.SaveSnapshot(2, `{}`))
+	assert.NoError(t, db.DeleteSnapshot(2))
+	snapshot, err = db.Snapshot(2)
+	assert.NoError(t, err)
+	assert.Empty(t, snapshot)
+}
+
+func TestNewPollConfig(t *testing.T) {
+	assert.Equal(t, nextcloud.PollUpdate{Access: nextcloud.ACCESS_PRIVATE}, NewPollConfig{}.update())
+	assert.Equal(t, nextcloud.PollUpdate{Access: nextcloud.ACCESS_OPEN, Anonymous: 1}, NewPollConfig{Access: nextcloud.ACCESS_OPEN, Anonymous: true}.update())
+	assert.Equal(t, DefaultExtendWeekends, NewPollConfig{}.weekends())
+	assert.NoError(t, NewPollConfig{Access: nextcloud.ACCESS_OPEN, Weekends: 8}.validate("new_poll"))
+	assert.EqualError(t, NewPollConfig{Access: "public", Weekends: 100}.validate("new_poll"), "new_poll.access must be private or open\nnew_poll.weekends must be between 0 and 26")
+
+	title, err := parseNewPollArgs([]string{"Season", "3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Season 3", title)
+	_, err = parseNewPollArgs(nil)
+	assert.Error(t, err)
+	_, err = parseNewPollArgs([]string{strings.Repeat("x", maxPollTitle+1)})
+	assert.Error(t, err)
+	// The limit is in characters, not bytes
+	title, err = parseNewPollArgs([]string{strings.Repeat("ä", maxPollTitle)})
+	assert.NoError(t, err)
+	assert.Equal(t, maxPollTitle, utf8.RuneCountInString(title))
+}
@@ -0,0 +1,96 @@
+// This file applies a changed configuration to the running bot.
+package telegram
+
+import (
+	"log"
+	"reflect"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+)
+
+// The configuration currently used by the bot
+func (t *TelegramBot) config() *TelegramConfig {
+	t.configLock.RLock()
+	defer t.configLock.RUnlock()
+	return t.configuration
+}
+
+// Settings that are only read when the bot starts. Changes to them are
+// ignored by Reload.
+func restartSettings(old *TelegramConfig, new *TelegramConfig) []string {
+	changed := []string{}
+	if old.Token != new.Token {
+		changed = append(changed, "token")
+	}
+	if old.Database != new.Database {
+		changed = append(changed, "database_path")
+	}
+	if old.PollInterval != new.PollInterval {
+		changed = append(changed, "poll_interval")
+	}
+	if old.Watch != new.Watch {
+		changed = append(changed, "watch")
+	}
+	if !reflect.DeepEqual(old.Encryption, new.Encryption) {
+		changed = append(changed, "encryption")
+	}
+	return changed
+}
+
+// Use the new configuration without restarting the bot. The chats, their
+// notification and retention settings, the backups and the Nextcloud
+// accounts are changed right away, the settings in restartSettings keep their
+// old value.
+func (t *TelegramBot) Reload(config *TelegramConfig, accounts []nextcloud.NextcloudConfig) {
+	reloaded := *config
+	t.configLock.Lock()
+	old := t.configuration
+	for _, setting := range restartSettings(old, &reloaded) {
+		log.Print("telegram.", setting, " changed - restart the bot to apply it")
+	}
+	reloaded.Token = old.Token
+	reloaded.Database = old.Database
+	reloaded.PollInterval = old.PollInterval
+	reloaded.Watch = old.Watch
+	reloaded.Encryption = old.Encryption
+	t.configuration = &reloaded
+	moved := movedChats(ApplyPollBindings(old.ChannelsToPolls, t.bindings), ApplyPollBindings(reloaded.ChannelsToPolls, t.bindings))
+	t.configLock.Unlock()
+
+	t.nextcloud.Reconfigure(accounts)
+	log.Print("Reloaded the configuration with ", len(reloaded.ChannelsToPolls), " chats")
+	t.mappingsChanged()
+	for _, channelId := range moved {
+		// The announced votes and the pinned schedule belong to the old poll.
+		t.lock.Lock()
+		err := t.db.DeleteSnapshot(channelId)
+		t.lock.Unlock()
+		if err != nil {
+			log.Print("Could not remove the snapshot of ", channelId, ": ", err)
+		}
+		t.refreshPinned(channelId)
+	}
+}
+
+// The chats that use another poll or account in the new mappings
+func movedChats(old []ChannelPollMapping, new []ChannelPollMapping) []int64 {
+	polls := map[int64]pollKey{}
+	for _, mapping := range old {
+		polls[mapping.ChannelId] = pollKey{account: mapping.Account, pollId: mapping.PollId}
+	}
+	moved := []int64{}
+	for _, mapping := range new {
+		if poll, ok := polls[mapping.ChannelId]; ok && !poll.matches(mapping) {
+			moved = append(moved, mapping.ChannelId)
+		}
+	}
+	return moved
+}
+
+// Tell the poll watcher that the chats use other polls now
+func (t *TelegramBot) mappingsChanged() {
+	select {
+	case t.remapped <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,45 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	pool := nextcloud.NewPool([]nextcloud.NextcloudConfig{{Server: "https://old.example.com"}})
+	bot := &TelegramBot{
+		configuration: &TelegramConfig{Token: "token", Database: "old.db", ChannelsToPolls: []ChannelPollMapping{{ChannelId: 1, PollId: 3}}},
+		nextcloud:     pool,
+		remapped:      make(chan struct{}, 1),
+	}
+	bot.Reload(&TelegramConfig{
+		Token:           "other",
+		Database:        "new.db",
+		Backup:          BackupConfig{Directory: "backups", IntervalHours: 12},
+		ChannelsToPolls: []ChannelPollMapping{{ChannelId: 1, PollId: 3, Quorum: 4}, {ChannelId: 2, PollId: 5}},
+	}, []nextcloud.NextcloudConfig{{Server: "https://new.example.com"}, {Name: "other", Server: "https://other.example.com"}})
+
+	config := bot.config()
+	assert.Equal(t, "token", config.Token)
+	assert.Equal(t, "old.db", config.Database)
+	assert.Equal(t, BackupConfig{Directory: "backups", IntervalHours: 12}, config.Backup)
+	assert.Equal(t, []ChannelPollMapping{{ChannelId: 1, PollId: 3, Quorum: 4}, {ChannelId: 2, PollId: 5}}, config.ChannelsToPolls)
+	assert.Equal(t, 5, bot.FindPollId(2))
+	client, err := pool.Client(nextcloud.DEFAULT_ACCOUNT)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://new.example.com", client.Options().Server)
+	client, err = pool.Client("other")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://other.example.com", client.Options().Server)
+	assert.Equal(t, []string{"token", "database_path"}, restartSettings(&TelegramConfig{Token: "a", Database: "a"}, &TelegramConfig{Token: "b", Database: "b"}))
+	// The watcher is told to subscribe to the new polls
+	assert.Len(t, bot.remapped, 1)
+}
+
+func TestMovedChats(t *testing.T) {
+	old := []ChannelPollMapping{{ChannelId: 1, PollId: 3}, {ChannelId: 2, PollId: 5}, {ChannelId: 3, PollId: 7}}
+	new := []ChannelPollMapping{{ChannelId: 1, PollId: 3, Quorum: 4}, {ChannelId: 2, PollId: 6}, {ChannelId: 3, PollId: 7, Account: "club"}, {ChannelId: 4, PollId: 8}}
+	assert.Equal(t, []int64{2, 3}, movedChats(old, new))
+}
@@ -0,0 +1,141 @@
+// This file limits how long received messages are kept.
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// How often the retention policy is enforced
+const purgeInterval time.Duration = time.Hour
+
+type RetentionConfig struct {
+	// Received messages older than this are removed - 0 keeps them forever
+	MaxAgeDays int `json:"max_age_days"`
+	// Only store who sent a message, when and of which kind, but not what it
+	// says - no text, captions, locations, contacts or poll questions
+	MetadataOnly bool `json:"metadata_only"`
+}
+
+func (r RetentionConfig) String() string {
+	age := "forever"
+	if r.MaxAgeDays > 0 {
+		age = fmt.Sprintf("for %d days", r.MaxAgeDays)
+	}
+	if r.MetadataOnly {
+		return fmt.Sprintf("Only the author and date of messages are stored %s, their text is not stored.", age)
+	}
+	return fmt.Sprintf("Messages are stored with their text %s.", age)
+}
+
+// Enforce the retention policy of all channels periodically
+func (t *TelegramBot) PurgeMessages() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		for _, mapping := range t.mappings() {
+			err := t.purgeChannel(mapping, time.Now())
+			if err != nil {
+				log.Print("Could not purge messages of ", mapping.ChannelId, ": ", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func (t *TelegramBot) purgeChannel(mapping ChannelPollMapping, now time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if mapping.Retention.MaxAgeDays > 0 {
+		removed, err := t.messages.DeleteBefore(mapping.ChannelId, RECEIVED, now.AddDate(0, 0, -mapping.Retention.MaxAgeDays))
+		if err != nil {
+			return err
+		}
+		if removed > 0 {
+			log.Print("Removed ", removed, " expired messages of ", mapping.ChannelId)
+		}
+	}
+	if mapping.Retention.MetadataOnly {
+		// Messages stored before the policy was enabled still have a text.
+		cleared, err := t.messages.ClearText(mapping.ChannelId, RECEIVED)
+		if err != nil {
+			return err
+		}
+		if cleared > 0 {
+			log.Print("Removed the text of ", cleared, " messages of ", mapping.ChannelId)
+		}
+	}
+	return nil
+}
+
+// Remove every stored message of the user who sent the command
+func (t *TelegramBot) ForgetMe(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	from := update.Message.From
+	if from == nil {
+		return nil
+	}
+	username := from.Username
+	if username == "" {
+		username = from.FirstName + " " + from.LastName
+	}
+	t.lock.Lock()
+	removed, err := t.messages.ForgetUser(chatId, from.ID, username)
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not forget messages of a user: ", err)
+		t.Send(chatId, `⚠ - Your messages could not be removed, please try again later.`, false)
+		return nil
+	}
+	t.Send(chatId, fmt.Sprintf(`🤖 - I removed %d of your messages from my memory. Your future messages are still stored according to /privacy.`, removed), false)
+	return nil
+}
+
+// Show the retention settings of the chat to its administrators
+func (t *TelegramBot) Privacy(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	if update.Message.From == nil || !t.isAdmin(chatId, update.Message.From.ID) {
+		t.Send(chatId, `⚠ - Only administrators of this chat can use /privacy.`, false)
+		return nil
+	}
+	t.lock.Lock()
+	count, err := t.messages.Count(chatId, MessageFilter{Type: RECEIVED})
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not count messages: ", err)
+		return err
+	}
+	lines := []string{
+		"🤖 - Privacy settings of this chat:",
+		t.FindMapping(chatId).Retention.String(),
+		fmt.Sprintf("%d received messages are stored right now.", count),
+		"Anyone can remove their own messages with /forgetme.",
+	}
+	t.Send(chatId, strings.Join(lines, "\n"), false)
+	return nil
+}
+
+// Whether the user may change or inspect the settings of the chat. Private
+// chats only have a single user, so they are always allowed.
+func (t *TelegramBot) isAdmin(chatId int64, userId int64) bool {
+	if chatId == userId {
+		return true
+	}
+	member, err := t.bot.GetChatMember(context.Background(), &telego.GetChatMemberParams{
+		ChatID: tu.ID(chatId),
+		UserID: userId,
+	})
+	if err != nil {
+		log.Print("Could not look up chat member: ", err)
+		return false
+	}
+	status := member.MemberStatus()
+	return status == telego.MemberStatusCreator || status == telego.MemberStatusAdministrator
+}
@@ -0,0 +1,52 @@
+package telegram
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	for _, store := range []MessageStore{db, NewMemoryStore()} {
+		now := time.Now().UTC().Truncate(time.Second)
+		old := &DBMessage{MsgId: 1, ChannelId: 1001, Date: now.AddDate(0, 0, -40), User: "anna", Text: "old", Type: RECEIVED, UserId: 7}
+		recent := &DBMessage{MsgId: 2, ChannelId: 1001, Date: now, User: "ben", Text: "recent", Type: RECEIVED, UserId: 8}
+		legacy := &DBMessage{MsgId: 3, ChannelId: 1002, Date: now, User: "anna", Text: "legacy", Type: RECEIVED}
+		// Another user who used the same name in another chat
+		namesake := &DBMessage{MsgId: 4, ChannelId: 1003, Date: now, User: "anna", Text: "namesake", Type: RECEIVED}
+		for _, msg := range []*DBMessage{old, recent, legacy, namesake} {
+			_, err := store.SaveMessage(msg)
+			assert.NoError(t, err)
+		}
+
+		removed, err := store.DeleteBefore(1001, RECEIVED, now.AddDate(0, 0, -30))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), removed)
+
+		cleared, err := store.ClearText(1001, RECEIVED)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), cleared)
+		received, err := store.ListReceived(1001, time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.Len(t, received, 1)
+		assert.Equal(t, "", received[0].Text)
+		assert.Equal(t, "ben", received[0].User)
+
+		forgotten, err := store.ForgetUser(1002, 7, "anna")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), forgotten)
+		count, err := store.Count(1002, MessageFilter{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, count)
+		count, err = store.Count(1003, MessageFilter{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	}
+}
@@ -0,0 +1,99 @@
+// This file maintains the pinned schedule message of each channel.
+package telegram
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bergmannf/rpgreminder/nextcloud"
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Format the options as the rows of a table, including the header
+func ScheduleRows(options []nextcloud.PollOption) []string {
+	formatStringHeader := "| %-10s | %-5s | %5s | %5s | %5s | %8s |"
+	formatStringOption := "| %-10s | %-5s | %5d | %5d | %5d | %6.2f %% |"
+	msgs := []string{fmt.Sprintf(formatStringHeader, "Weekday", "Date", "Yes", "No", "Maybe", "Total")}
+	for _, opt := range options {
+		timeVotes := opt.Votes.Yes + opt.Votes.Maybe
+		allVotes := opt.Votes.Yes + opt.Votes.Maybe + opt.Votes.No
+		percent := (float32(timeVotes) / float32(allVotes)) * 100
+		msg := fmt.Sprintf(formatStringOption,
+			opt.Datetime().Weekday(),
+			opt.Datetime().Format("02/01"),
+			opt.Votes.Yes,
+			opt.Votes.No,
+			opt.Votes.Maybe,
+			percent,
+		)
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// Format the options as a table that can be sent as MarkdownV2
+func ScheduleTable(options []nextcloud.PollOption) string {
+	if len(options) == 0 {
+		return `🤖 \- No poll options in that time frame\.`
+	}
+	return fmt.Sprintf("```text\n%s```", strings.Join(ScheduleRows(options), "\n"))
+}
+
+// Reload the poll of the channel and update the pinned schedule message.
+func (t *TelegramBot) RefreshSchedule(channelId int64) error {
+	poll, err := t.loadPoll(t.FindMapping(channelId))
+	if err != nil {
+		return err
+	}
+	return t.UpdatePinned(channelId, ScheduleTable(nextcloud.NextWeekend(poll)))
+}
+
+// Edit the pinned schedule message of the channel in place.
+//
+// If there is no pinned message yet or it can not be edited anymore (e.g.
+// because it was deleted) a new message is sent and pinned instead.
+func (t *TelegramBot) UpdatePinned(channelId int64, msg string) error {
+	msgId, err := t.pinnedMessage(channelId)
+	if err != nil {
+		return err
+	}
+	if msgId != 0 {
+		_, err = t.bot.EditMessageText(context.Background(), &telego.EditMessageTextParams{
+			ChatID:    tu.ID(channelId),
+			MessageID: msgId,
+			Text:      msg,
+			ParseMode: "MarkdownV2",
+		})
+		if err == nil || strings.Contains(err.Error(), "message is not modified") {
+			log.Print("Updated pinned schedule message: ", msgId)
+			return nil
+		}
+		log.Print("Could not edit pinned schedule message ", msgId, " - sending a new one: ", err)
+	}
+	sent := t.sendMessage(channelId, msg, true)
+	if sent == nil {
+		return fmt.Errorf("could not send schedule message to %d", channelId)
+	}
+	err = t.bot.PinChatMessage(context.Background(), &telego.PinChatMessageParams{
+		ChatID:              tu.ID(channelId),
+		MessageID:           sent.MessageID,
+		DisableNotification: true,
+	})
+	if err != nil {
+		// Without admin rights the message can not be pinned, it can still
+		// be edited in place though.
+		log.Print("Could not pin schedule message: ", err)
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.db.SetPinnedMessage(channelId, sent.MessageID)
+}
+
+func (t *TelegramBot) pinnedMessage(channelId int64) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.db.PinnedMessage(channelId)
+}
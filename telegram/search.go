@@ -0,0 +1,216 @@
+// This file searches the text of stored messages.
+package telegram
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Number of messages returned by /search
+const searchResults int = 10
+
+// The search index is only available if the SQLite driver is built with
+// FTS5, e.g. `go build -tags sqlite_fts5`. It only contains data derived from
+// the messages table, so it is created outside of the migrations and rebuilt
+// whenever it may be outdated.
+const FTS5_AVAILABLE string = `SELECT sqlite_compileoption_used('ENABLE_FTS5')`
+const SEARCH_TABLE string = `CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING fts5(text, caption, content='messages', content_rowid='id')`
+const SEARCH_CLEAR string = `INSERT INTO messages_fts(messages_fts) VALUES('delete-all')`
+const SEARCH_TRIGGERS_EXIST string = `SELECT count(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'messages_fts_%'`
+
+// Encrypted values are not indexed, the index would otherwise either be
+// useless or reveal the text.
+const SEARCH_POPULATE string = `INSERT INTO messages_fts(rowid, text, caption)
+SELECT id, CASE WHEN text LIKE 'enc:%' THEN NULL ELSE text END, CASE WHEN caption LIKE 'enc:%' THEN NULL ELSE caption END
+FROM messages WHERE type = 'received'`
+const SEARCH_INSERT_TRIGGER string = `CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages WHEN new.type = 'received'
+BEGIN
+INSERT INTO messages_fts(rowid, text, caption) VALUES(new.id,
+CASE WHEN new.text LIKE 'enc:%' THEN NULL ELSE new.text END,
+CASE WHEN new.caption LIKE 'enc:%' THEN NULL ELSE new.caption END);
+END`
+const SEARCH_DELETE_TRIGGER string = `CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages WHEN old.type = 'received'
+BEGIN
+INSERT INTO messages_fts(messages_fts, rowid, text, caption) VALUES('delete', old.id,
+CASE WHEN old.text LIKE 'enc:%' THEN NULL ELSE old.text END,
+CASE WHEN old.caption LIKE 'enc:%' THEN NULL ELSE old.caption END);
+END`
+const SEARCH_UPDATE_TRIGGER string = `CREATE TRIGGER IF NOT EXISTS messages_fts_update AFTER UPDATE OF text, caption ON messages WHEN old.type = 'received'
+BEGIN
+INSERT INTO messages_fts(messages_fts, rowid, text, caption) VALUES('delete', old.id,
+CASE WHEN old.text LIKE 'enc:%' THEN NULL ELSE old.text END,
+CASE WHEN old.caption LIKE 'enc:%' THEN NULL ELSE old.caption END);
+INSERT INTO messages_fts(rowid, text, caption) VALUES(new.id,
+CASE WHEN new.text LIKE 'enc:%' THEN NULL ELSE new.text END,
+CASE WHEN new.caption LIKE 'enc:%' THEN NULL ELSE new.caption END);
+END`
+const SEARCH_QUERY string = `SELECT ` + MESSAGE_COLUMNS + ` FROM messages
+JOIN (SELECT rowid AS hit, bm25(messages_fts) AS score FROM messages_fts WHERE messages_fts MATCH ?) ON hit = id
+WHERE channelId = ? AND type = 'received' AND deleted IS NULL ORDER BY score, date DESC LIMIT ?`
+
+var searchTriggers = []string{"messages_fts_insert", "messages_fts_delete", "messages_fts_update"}
+
+// Create the search index if FTS5 is available. Without FTS5 the triggers of
+// an existing index are removed, as they would make every insert fail. The
+// index is rebuilt once FTS5 is available again.
+func (db *MessageDB) setupSearchIndex() error {
+	err := db.connection.QueryRow(FTS5_AVAILABLE).Scan(&db.search)
+	if err != nil {
+		return err
+	}
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if !db.search {
+		log.Print("SQLite was built without FTS5, /search has to scan all messages")
+		for _, trigger := range searchTriggers {
+			_, err = tx.Exec("DROP TRIGGER IF EXISTS " + trigger)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	var triggers int
+	err = tx.QueryRow(SEARCH_TRIGGERS_EXIST).Scan(&triggers)
+	if err != nil {
+		return err
+	}
+	if triggers == len(searchTriggers) {
+		return nil
+	}
+	log.Print("Building the search index")
+	for _, statement := range []string{SEARCH_TABLE, SEARCH_CLEAR, SEARCH_POPULATE, SEARCH_INSERT_TRIGGER, SEARCH_DELETE_TRIGGER, SEARCH_UPDATE_TRIGGER} {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Split the text into lower case words
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Build an FTS5 query that matches messages containing words starting with
+// every term. The terms are quoted, so they can not use the query syntax.
+func ftsQuery(terms []string) string {
+	quoted := []string{}
+	for _, term := range terms {
+		quoted = append(quoted, `"`+strings.ReplaceAll(term, `"`, `""`)+`"*`)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Return the messages that contain words starting with every term, the
+// messages with the most matches first. Used when the search index can not
+// be used.
+func matchMessages(messages []DBMessage, terms []string, limit int) []DBMessage {
+	scores := map[int64]float64{}
+	matching := []DBMessage{}
+	for _, msg := range messages {
+		text := words(msg.Text + " " + msg.Caption)
+		hits := 0
+		for _, term := range terms {
+			found := 0
+			for _, word := range text {
+				if strings.HasPrefix(word, term) {
+					found++
+				}
+			}
+			if found == 0 {
+				hits = 0
+				break
+			}
+			hits += found
+		}
+		if hits > 0 {
+			scores[msg.Id] = float64(hits) / math.Sqrt(float64(len(text)))
+			matching = append(matching, msg)
+		}
+	}
+	slices.SortStableFunc(matching, func(a DBMessage, b DBMessage) int {
+		if scores[a.Id] != scores[b.Id] {
+			return -cmpFloat(scores[a.Id], scores[b.Id])
+		}
+		return b.Date.Compare(a.Date)
+	})
+	return matching[:min(limit, len(matching))]
+}
+
+func (db *MessageDB) Search(channelId int64, terms []string, limit int) ([]DBMessage, error) {
+	if len(terms) == 0 {
+		return []DBMessage{}, nil
+	}
+	// Encrypted messages are not in the index, so they have to be decrypted
+	// and searched one by one.
+	if db.search && db.cipher == nil {
+		return db.query(SEARCH_QUERY, ftsQuery(terms), channelId, limit)
+	}
+	messages, err := db.list(channelId, MessageFilter{Type: RECEIVED})
+	if err != nil {
+		return nil, err
+	}
+	return matchMessages(messages, terms, limit), nil
+}
+
+// A link to the message - empty if the chat has no links
+func messageLink(chat telego.Chat, msgId int) string {
+	if chat.Username != "" {
+		return fmt.Sprintf("https://t.me/%s/%d", chat.Username, msgId)
+	}
+	// Supergroups and channels have IDs prefixed with -100, only members
+	// can open these links.
+	if chat.ID < -1000000000000 {
+		return fmt.Sprintf("https://t.me/c/%d/%d", -chat.ID-1000000000000, msgId)
+	}
+	return ""
+}
+
+// Search the stored messages of the chat
+func (t *TelegramBot) Search(ctx *th.Context, update telego.Update) error {
+	chat := update.Message.Chat
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	terms := words(strings.Join(args, " "))
+	if len(terms) == 0 {
+		t.SendUsageError(chat.ID, fmt.Errorf("use /search followed by the words to look for, e.g. /search dragon name"))
+		return nil
+	}
+	t.lock.Lock()
+	found, err := t.messages.Search(chat.ID, terms, searchResults)
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not search messages: ", err)
+		t.Send(chat.ID, `⚠ - The messages could not be searched, please try again later.`, false)
+		return nil
+	}
+	query := strings.Join(args, " ")
+	if len(found) == 0 {
+		t.Send(chat.ID, fmt.Sprintf(`🤖 - No messages match "%s".`, query), false)
+		return nil
+	}
+	lines := []string{fmt.Sprintf(`🤖 - These messages match "%s":`, query)}
+	for _, msg := range found {
+		line := fmt.Sprintf("%s %s: %s", msg.Date.Local().Format("2006-01-02"), msg.User, shorten(summaryText(&msg), summaryQuoteLength))
+		if link := messageLink(chat, msg.MsgId); link != "" {
+			line += " " + link
+		}
+		lines = append(lines, line)
+	}
+	t.Send(chat.ID, strings.Join(lines, "\n"), false)
+	return nil
+}
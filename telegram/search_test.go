@@ -0,0 +1,88 @@
+package telegram
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+	"github.com/stretchr/testify/assert"
+)
+
+func testSearch(t *testing.T, store MessageStore) {
+	date := time.Date(2026, 10, 18, 18, 0, 0, 0, time.UTC)
+	for i, text := range []string{
+		"The dragon is called Smaug",
+		"Who brings snacks?",
+		"Dragons again, the dragon's name was Smaug",
+		"Smaug",
+	} {
+		_, err := store.SaveMessage(&DBMessage{MsgId: i + 1, ChannelId: 1001, Date: date.Add(time.Duration(i) * time.Minute), User: "anna", Text: text, Type: RECEIVED})
+		assert.NoError(t, err)
+	}
+	_, err := store.SaveMessage(&DBMessage{MsgId: 9, ChannelId: 1002, Date: date, User: "bob", Text: "Smaug the dragon", Type: RECEIVED})
+	assert.NoError(t, err)
+
+	found, err := store.Search(1001, words("Dragon SMAUG"), 10)
+	assert.NoError(t, err)
+	ids := []int{}
+	for _, msg := range found {
+		ids = append(ids, msg.MsgId)
+	}
+	assert.ElementsMatch(t, []int{1, 3}, ids)
+
+	found, err = store.Search(1001, words("snack"), 10)
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+
+	// Edits and deletions are reflected in the results
+	_, err = store.EditMessage(1001, 2, "Who brings drinks?", date.Add(time.Hour))
+	assert.NoError(t, err)
+	found, err = store.Search(1001, words("snack"), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+	found, err = store.Search(1001, words("drinks"), 10)
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+	assert.NoError(t, store.MarkDeleted([]int64{found[0].Id}, date.Add(time.Hour)))
+	found, err = store.Search(1001, words("drinks"), 10)
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+
+	found, err = store.Search(1001, words("smaug"), 1)
+	assert.NoError(t, err)
+	assert.Len(t, found, 1)
+}
+
+func TestSearch(t *testing.T) {
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	testSearch(t, db)
+	testSearch(t, NewMemoryStore())
+}
+
+func TestSearchEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.db")
+	db, err := OpenDatabase(path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+	key, err := NewCipher(testKey('a'))
+	assert.NoError(t, err)
+	db.SetCipher(key)
+	testSearch(t, db)
+}
+
+func TestFtsQuery(t *testing.T) {
+	assert.Equal(t, `"dragon"* "na""me"*`, ftsQuery([]string{"dragon", `na"me`}))
+}
+
+func TestMessageLink(t *testing.T) {
+	assert.Equal(t, "https://t.me/rpggroup/12", messageLink(telego.Chat{ID: -1001234567890, Username: "rpggroup"}, 12))
+	assert.Equal(t, "https://t.me/c/1234567890/12", messageLink(telego.Chat{ID: -1001234567890}, 12))
+	assert.Equal(t, "", messageLink(telego.Chat{ID: -12345}, 12))
+}
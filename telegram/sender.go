@@ -0,0 +1,378 @@
+// This file delivers queued messages while respecting the Telegram rate limits.
+package telegram
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Starts the notice about a message that could not be delivered
+const undeliveredPrefix string = "⚠ - A message to chat "
+
+// Maximum length of a message in UTF-16 code units
+const messageLimit int = 4096
+
+// Telegram allows about one message per second in private chats, 20 messages
+// per minute in groups and 30 messages per second overall.
+const privateChatInterval time.Duration = time.Second
+const groupChatInterval time.Duration = 3 * time.Second
+const globalInterval time.Duration = time.Second / 30
+
+// Messages are given up after this many failed attempts
+const maxSendAttempts int = 5
+
+// How long sendMessage waits for a message to be delivered
+const sendTimeout time.Duration = 5 * time.Minute
+
+const codeBlockStart string = "```text\n"
+const codeBlockEnd string = "```"
+
+const SENDQUEUE_INSERT string = `INSERT INTO sendqueue (channelId, text, markdown, nextAttempt) VALUES(?, ?, ?, ?)`
+const SENDQUEUE_PENDING string = `SELECT id, channelId, text, markdown, status, attempts, nextAttempt, lastError FROM sendqueue WHERE status = 'pending' ORDER BY id`
+const SENDQUEUE_UPDATE string = `UPDATE sendqueue SET status = ?, attempts = ?, nextAttempt = ?, lastError = ? WHERE id = ?`
+const SENDQUEUE_DELETE string = `DELETE FROM sendqueue WHERE id = ?`
+
+// A message waiting to be sent
+type QueuedMessage struct {
+	Id          int64
+	ChannelId   int64
+	Text        string
+	Markdown    bool
+	Status      string
+	Attempts    int
+	NextAttempt time.Time
+	LastError   sql.NullString
+}
+
+func (db *MessageDB) QueueMessage(channelId int64, text string, markdown bool) (int64, error) {
+	tx, err := db.connection.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(SENDQUEUE_INSERT, channelId, "", markdown, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	err = db.encryptRow(tx, "sendqueue", id, []string{"text"}, []string{text})
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// All messages that were not sent yet, oldest first
+func (db *MessageDB) PendingMessages() ([]QueuedMessage, error) {
+	rows, err := db.connection.Query(SENDQUEUE_PENDING)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []QueuedMessage{}
+	for rows.Next() {
+		var m QueuedMessage
+		err = rows.Scan(&m.Id, &m.ChannelId, &m.Text, &m.Markdown, &m.Status, &m.Attempts, &m.NextAttempt, &m.LastError)
+		if err != nil {
+			return nil, err
+		}
+		m.Text, err = db.cipher.Decrypt(m.Text, Field{Table: "sendqueue", Column: "text", Row: m.Id})
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+func (db *MessageDB) UpdateQueuedMessage(m *QueuedMessage) error {
+	_, err := db.connection.Exec(SENDQUEUE_UPDATE, m.Status, m.Attempts, m.NextAttempt.UTC(), m.LastError, m.Id)
+	return err
+}
+
+func (db *MessageDB) DeleteQueuedMessage(id int64) error {
+	_, err := db.connection.Exec(SENDQUEUE_DELETE, id)
+	return err
+}
+
+func utf16Len(s string) int {
+	length := 0
+	for _, r := range s {
+		length += utf16.RuneLen(r)
+	}
+	return length
+}
+
+// Split the text into parts of at most limit UTF-16 code units, preferring to
+// split between lines. Escaped MarkdownV2 text is not cut between a backslash
+// and the character it escapes.
+func splitMessage(text string, limit int, escaped bool) []string {
+	if utf16Len(text) <= limit {
+		return []string{text}
+	}
+	parts := []string{}
+	current, currentLen := "", 0
+	flush := func() {
+		if current != "" {
+			parts = append(parts, current)
+		}
+		current, currentLen = "", 0
+	}
+	for _, line := range strings.SplitAfter(text, "\n") {
+		lineLen := utf16Len(line)
+		if currentLen+lineLen > limit {
+			flush()
+		}
+		for lineLen > limit {
+			// A single line that is too long has to be cut.
+			cut, cutLen := 0, 0
+			for i, r := range line {
+				if cutLen+utf16.RuneLen(r) > limit {
+					cut = i
+					break
+				}
+				cutLen += utf16.RuneLen(r)
+			}
+			if escaped && cut > 1 && trailingBackslashes(line[:cut])%2 == 1 {
+				cut--
+				cutLen--
+			}
+			parts = append(parts, line[:cut])
+			line = line[cut:]
+			lineLen -= cutLen
+		}
+		current += line
+		currentLen += lineLen
+	}
+	flush()
+	return parts
+}
+
+func trailingBackslashes(s string) int {
+	return len(s) - len(strings.TrimRight(s, `\`))
+}
+
+// Split a message so every part fits into a Telegram message. A table sent as
+// a code block is split into several code blocks.
+func messageParts(msg string, markdown bool) []string {
+	if markdown && strings.HasPrefix(msg, codeBlockStart) && strings.HasSuffix(msg, codeBlockEnd) && len(msg) >= len(codeBlockStart)+len(codeBlockEnd) {
+		inner := msg[len(codeBlockStart) : len(msg)-len(codeBlockEnd)]
+		parts := []string{}
+		for _, part := range splitMessage(inner, messageLimit-len(codeBlockStart)-len(codeBlockEnd), true) {
+			parts = append(parts, codeBlockStart+part+codeBlockEnd)
+		}
+		return parts
+	}
+	return splitMessage(msg, messageLimit, markdown)
+}
+
+// Store the message in the send queue and wake up the sender. The returned
+// channel receives the last delivered part or nil if it could not be sent.
+func (t *TelegramBot) queueMessage(channel int64, msg string, markdown bool) chan *telego.Message {
+	result := make(chan *telego.Message, 1)
+	var last int64
+	t.lock.Lock()
+	for _, part := range messageParts(msg, markdown) {
+		id, err := t.db.QueueMessage(channel, part, markdown)
+		if err != nil {
+			log.Print("Could not queue message for ", channel, ": ", err)
+			continue
+		}
+		last = id
+	}
+	t.lock.Unlock()
+	if last == 0 {
+		result <- nil
+		return result
+	}
+	t.sendLock.Lock()
+	t.waiters[last] = result
+	t.sendLock.Unlock()
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return result
+}
+
+func (t *TelegramBot) notifyWaiter(id int64, sent *telego.Message) {
+	t.sendLock.Lock()
+	defer t.sendLock.Unlock()
+	if waiter, ok := t.waiters[id]; ok {
+		waiter <- sent
+		delete(t.waiters, id)
+	}
+}
+
+// The chat to tell that the message was given up and the notice - the admin
+// chat if one is configured, as the chat itself may not accept messages from
+// the bot anymore. Notices that fail are not reported again.
+func undeliveredNotice(m *QueuedMessage, adminChat int64) (int64, string, bool) {
+	if strings.HasPrefix(m.Text, undeliveredPrefix) {
+		return 0, "", false
+	}
+	chat := m.ChannelId
+	if adminChat != 0 {
+		chat = adminChat
+	}
+	return chat, fmt.Sprintf("%s%d could not be delivered: %s", undeliveredPrefix, m.ChannelId, m.LastError.String), true
+}
+
+func chatInterval(channel int64) time.Duration {
+	// Groups and channels have negative IDs.
+	if channel < 0 {
+		return groupChatInterval
+	}
+	return privateChatInterval
+}
+
+// The message to send now - only the oldest message of a chat is sent, so
+// the parts of a message arrive in order even if one of them had to be
+// retried. Otherwise returns when the next message can be sent, or the zero
+// time if there is nothing left to send.
+func nextMessage(messages []QueuedMessage, chatReady map[int64]time.Time, now time.Time) (*QueuedMessage, time.Time) {
+	var next time.Time
+	seen := map[int64]bool{}
+	for i := range messages {
+		m := &messages[i]
+		if seen[m.ChannelId] {
+			continue
+		}
+		seen[m.ChannelId] = true
+		ready := chatReady[m.ChannelId]
+		if m.NextAttempt.After(ready) {
+			ready = m.NextAttempt
+		}
+		if !ready.After(now) {
+			return m, time.Time{}
+		}
+		if next.IsZero() || ready.Before(next) {
+			next = ready
+		}
+	}
+	return nil, next
+}
+
+// Send the queued messages one at a time, keeping to the rate limits per chat
+// and overall. Messages survive a restart of the bot as they are stored in the
+// database until they were delivered. The sender sleeps until the next
+// message is due or a new one is queued.
+func (t *TelegramBot) DeliverMessages() {
+	chatReady := map[int64]time.Time{}
+	var globalReady time.Time
+	for {
+		t.lock.Lock()
+		messages, err := t.db.PendingMessages()
+		t.lock.Unlock()
+		now := time.Now()
+		var wakeAt time.Time
+		if err != nil {
+			log.Print("Could not load the send queue: ", err)
+			wakeAt = now.Add(time.Second)
+		} else if now.Before(globalReady) {
+			wakeAt = globalReady
+		} else {
+			var next *QueuedMessage
+			next, wakeAt = nextMessage(messages, chatReady, now)
+			if next != nil {
+				retryAfter := t.deliver(next)
+				globalReady = time.Now().Add(globalInterval)
+				chatReady[next.ChannelId] = time.Now().Add(max(chatInterval(next.ChannelId), retryAfter))
+				continue
+			}
+		}
+		var timer <-chan time.Time
+		if !wakeAt.IsZero() {
+			timer = time.After(wakeAt.Sub(now))
+		}
+		select {
+		case <-t.wake:
+		case <-timer:
+		}
+	}
+}
+
+// Send the message right away without the send queue, for the command line
+// where no sender is running. A bot running at the same time could otherwise
+// deliver the same queued message.
+func (t *TelegramBot) SendNow(channel int64, msg string, markdown bool) error {
+	for _, part := range messageParts(msg, markdown) {
+		params := tu.Message(tu.ID(channel), part)
+		if markdown {
+			params.ParseMode = "MarkdownV2"
+		}
+		sent, err := t.bot.SendMessage(context.Background(), params)
+		if err != nil {
+			return fmt.Errorf("could not send message to %d: %w", channel, err)
+		}
+		t.storeMessage(sent, SENT)
+	}
+	return nil
+}
+
+// Send a single message and record the outcome. Returns how long Telegram
+// asked to wait before sending to the chat again.
+func (t *TelegramBot) deliver(m *QueuedMessage) time.Duration {
+	params := tu.Message(tu.ID(m.ChannelId), m.Text)
+	if m.Markdown {
+		params.ParseMode = "MarkdownV2"
+	}
+	sent, err := t.bot.SendMessage(context.Background(), params)
+	if err == nil {
+		log.Print("Send message with ID: ", sent.MessageID)
+		t.storeMessage(sent, SENT)
+		t.lock.Lock()
+		err = t.db.DeleteQueuedMessage(m.Id)
+		t.lock.Unlock()
+		if err != nil {
+			log.Print("Could not remove message ", m.Id, " from the send queue: ", err)
+		}
+		t.notifyWaiter(m.Id, sent)
+		return 0
+	}
+	var retryAfter time.Duration
+	var apiErr *ta.Error
+	isApiErr := errors.As(err, &apiErr)
+	m.LastError = sql.NullString{String: err.Error(), Valid: true}
+	if isApiErr && apiErr.Parameters != nil && apiErr.Parameters.RetryAfter > 0 {
+		// Flood control does not count as a failed attempt.
+		retryAfter = time.Duration(apiErr.Parameters.RetryAfter) * time.Second
+		log.Print("Flood control for ", m.ChannelId, " - retrying message ", m.Id, " in ", retryAfter)
+		m.NextAttempt = time.Now().Add(retryAfter)
+	} else {
+		m.Attempts++
+		permanent := isApiErr && apiErr.ErrorCode >= 400 && apiErr.ErrorCode < 500 && apiErr.ErrorCode != http.StatusTooManyRequests
+		if permanent || m.Attempts >= maxSendAttempts {
+			m.Status = FAILED
+			log.Print("Giving up on message ", m.Id, " to ", m.ChannelId, " after ", m.Attempts, " attempts: ", err)
+			t.notifyWaiter(m.Id, nil)
+			if chat, notice, ok := undeliveredNotice(m, t.config().AdminChat); ok {
+				t.Send(chat, notice, false)
+			}
+		} else {
+			m.NextAttempt = time.Now().Add(5 * time.Second << m.Attempts)
+			log.Print("Could not send message ", m.Id, " - retrying: ", err)
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	err = t.db.UpdateQueuedMessage(m)
+	if err != nil {
+		log.Print("Could not update message ", m.Id, " in the send queue: ", err)
+	}
+	return retryAfter
+}
@@ -0,0 +1,122 @@
+package telegram
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mymmrac/telego"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMessage(t *testing.T) {
+	assert.Equal(t, []string{"short"}, splitMessage("short", 10, false))
+	assert.Equal(t, []string{"line one\n", "line two\n", "three"}, splitMessage("line one\nline two\nthree", 10, false))
+	assert.Equal(t, []string{"abcd", "efgh", "ij"}, splitMessage("abcdefghij", 4, false))
+	// Emojis take two UTF-16 code units and must not be cut in half.
+	assert.Equal(t, []string{"a🤖", "🤖"}, splitMessage("a🤖🤖", 3, false))
+	// Escape sequences stay together, escaped backslashes are no escapes.
+	assert.Equal(t, []string{"abc", `\.d`}, splitMessage(`abc\.d`, 4, true))
+	assert.Equal(t, []string{`ab\\`, "cd"}, splitMessage(`ab\\cd`, 4, true))
+	assert.Equal(t, []string{`abc\`, ".d"}, splitMessage(`abc\.d`, 4, false))
+}
+
+func TestMessagePartsCodeBlock(t *testing.T) {
+	line := strings.Repeat("x", 99) + "\n"
+	msg := codeBlockStart + strings.Repeat(line, 100) + codeBlockEnd
+	parts := messageParts(msg, true)
+	assert.Len(t, parts, 3)
+	for _, part := range parts {
+		assert.LessOrEqual(t, utf16Len(part), messageLimit)
+		assert.True(t, strings.HasPrefix(part, codeBlockStart))
+		assert.True(t, strings.HasSuffix(part, codeBlockEnd))
+	}
+	assert.Equal(t, []string{"no markdown"}, messageParts("no markdown", false))
+}
+
+func TestUndeliveredNotice(t *testing.T) {
+	m := &QueuedMessage{ChannelId: -1001, Text: "hello", LastError: sql.NullString{String: "Forbidden: bot was kicked", Valid: true}}
+	chat, notice, ok := undeliveredNotice(m, 0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(-1001), chat)
+	assert.Equal(t, "⚠ - A message to chat -1001 could not be delivered: Forbidden: bot was kicked", notice)
+	chat, _, _ = undeliveredNotice(m, 42)
+	assert.Equal(t, int64(42), chat)
+	// A notice that fails is not reported again
+	_, _, ok = undeliveredNotice(&QueuedMessage{ChannelId: 42, Text: notice}, 42)
+	assert.False(t, ok)
+}
+
+func TestNextMessage(t *testing.T) {
+	now := time.Now()
+	messages := []QueuedMessage{
+		{Id: 1, ChannelId: 1001, NextAttempt: now.Add(time.Minute)},
+		{Id: 2, ChannelId: 1001, NextAttempt: now},
+		{Id: 3, ChannelId: 1002, NextAttempt: now},
+	}
+	// A part that is retried holds back the later parts of its chat
+	next, _ := nextMessage(messages, map[int64]time.Time{}, now)
+	assert.Equal(t, int64(3), next.Id)
+	next, at := nextMessage(messages, map[int64]time.Time{1002: now.Add(time.Second)}, now)
+	assert.Nil(t, next)
+	assert.Equal(t, now.Add(time.Second), at)
+	next, at = nextMessage(messages[:2], map[int64]time.Time{}, now)
+	assert.Nil(t, next)
+	assert.Equal(t, now.Add(time.Minute), at)
+	next, _ = nextMessage(messages[:2], map[int64]time.Time{}, now.Add(time.Minute))
+	assert.Equal(t, int64(1), next.Id)
+	next, at = nextMessage(nil, map[int64]time.Time{}, now)
+	assert.Nil(t, next)
+	assert.True(t, at.IsZero())
+}
+
+func TestDeliverRetries(t *testing.T) {
+	responses := []string{
+		`{"ok": false, "error_code": 500, "description": "Internal Server Error"}`,
+		`{"ok": false, "error_code": 429, "description": "Too Many Requests: retry after 7", "parameters": {"retry_after": 7}}`,
+		`{"ok": true, "result": {"message_id": 5, "date": 1763074800, "chat": {"id": 1001, "type": "private"}, "text": "hello"}}`,
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[requests]))
+		requests++
+	}))
+	defer server.Close()
+	api, err := telego.NewBot("123456:"+strings.Repeat("a", 35), telego.WithAPIServer(server.URL), telego.WithDiscardLogger())
+	assert.NoError(t, err)
+	db, err := OpenDatabase(filepath.Join(t.TempDir(), "messages.db"))
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	bot := &TelegramBot{bot: api, configuration: &TelegramConfig{}, db: db, messages: db, waiters: map[int64]chan *telego.Message{}}
+	_, err = db.QueueMessage(1001, "hello", false)
+	assert.NoError(t, err)
+
+	// Errors of the server are retried with a backoff
+	pending, err := db.PendingMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), bot.deliver(&pending[0]))
+	pending, err = db.PendingMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, PENDING, pending[0].Status)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.True(t, pending[0].NextAttempt.After(time.Now()))
+
+	// Flood control waits as long as Telegram asks without counting an attempt
+	assert.Equal(t, 7*time.Second, bot.deliver(&pending[0]))
+	pending, err = db.PendingMessages()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pending[0].Attempts)
+	assert.WithinDuration(t, time.Now().Add(7*time.Second), pending[0].NextAttempt, 2*time.Second)
+
+	assert.Equal(t, time.Duration(0), bot.deliver(&pending[0]))
+	pending, err = db.PendingMessages()
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.Equal(t, 3, requests)
+}
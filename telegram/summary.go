@@ -0,0 +1,240 @@
+// This file summarizes the stored messages of a chat without any external service.
+package telegram
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Number of messages quoted in a summary
+const summaryHighlights int = 5
+
+// Number of keywords listed in a summary
+const summaryKeywords int = 8
+
+// Quoted messages are shortened to this many characters
+const summaryQuoteLength int = 160
+
+// Words that say nothing about the topic of a message
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, word := range strings.Fields(`
+about after again all also and any are because been before but can could did does
+doing don for from had has have her here hers him his how into its just let like
+more most not now off once only other our out over own same she should some such
+than that the their them then there these they this those through too under until
+very was were what when where which while who why will with would you your yes okay
+aber alle als auch auf aus bei bin bis bist das dass dem den der des die dir doch
+du ein eine einem einen einer er es für hab habe hat hatte ich ihr im in ist ja
+kann mal man mir mit nach nicht noch nur oder schon sich sie sind so über um und uns
+von war was wenn wie wir wird zu zum zur`) {
+		stopWords[word] = true
+	}
+}
+
+// How many messages a user wrote
+type UserActivity struct {
+	User     string
+	Messages int
+}
+
+// A message that was picked for the summary
+type Highlight struct {
+	Message DBMessage
+	Replies int
+}
+
+type Summary struct {
+	Since    time.Time
+	Messages int
+	Keywords []string
+	Users    []UserActivity
+	// The most relevant messages, oldest first
+	Highlights []Highlight
+}
+
+// Split the text into lower case words, dropping short and common words
+func keywords(text string) []string {
+	return slices.DeleteFunc(words(text), func(word string) bool {
+		return len([]rune(word)) < 3 || stopWords[word]
+	})
+}
+
+// The text of a message that is used for the summary
+func summaryText(msg *DBMessage) string {
+	return strings.TrimSpace(msg.Text + " " + msg.Caption)
+}
+
+// Summarize the messages by picking the messages that contain the most
+// frequent keywords or received the most replies.
+func Summarize(messages []DBMessage, since time.Time) Summary {
+	summary := Summary{Since: since, Messages: len(messages)}
+
+	// A keyword is weighted by the number of messages that contain it, so a
+	// single message repeating a word does not dominate.
+	weights := map[string]int{}
+	activity := map[string]int{}
+	replies := map[int]int{}
+	for i := range messages {
+		activity[messages[i].User]++
+		if messages[i].ReplyTo != 0 {
+			replies[messages[i].ReplyTo]++
+		}
+		seen := map[string]bool{}
+		for _, word := range keywords(summaryText(&messages[i])) {
+			if !seen[word] {
+				seen[word] = true
+				weights[word]++
+			}
+		}
+	}
+
+	for word, weight := range weights {
+		// Words used only once are not a topic of the conversation.
+		if weight > 1 {
+			summary.Keywords = append(summary.Keywords, word)
+		}
+	}
+	slices.SortFunc(summary.Keywords, func(a string, b string) int {
+		if weights[a] != weights[b] {
+			return weights[b] - weights[a]
+		}
+		return strings.Compare(a, b)
+	})
+	summary.Keywords = summary.Keywords[:min(summaryKeywords, len(summary.Keywords))]
+
+	for user, count := range activity {
+		summary.Users = append(summary.Users, UserActivity{User: user, Messages: count})
+	}
+	slices.SortFunc(summary.Users, func(a UserActivity, b UserActivity) int {
+		if a.Messages != b.Messages {
+			return b.Messages - a.Messages
+		}
+		return strings.Compare(a.User, b.User)
+	})
+
+	scores := map[int64]float64{}
+	candidates := []Highlight{}
+	for _, msg := range messages {
+		words := keywords(summaryText(&msg))
+		if len(words) == 0 && replies[msg.MsgId] == 0 {
+			continue
+		}
+		score := 0.0
+		seen := map[string]bool{}
+		for _, word := range words {
+			if !seen[word] {
+				seen[word] = true
+				score += float64(weights[word] - 1)
+			}
+		}
+		// Normalize by length so long messages are not always picked. A reply
+		// counts as much as a keyword used in a tenth of the messages.
+		score = score/math.Sqrt(float64(len(words)+1)) + float64(replies[msg.MsgId]*len(messages))/10
+		scores[msg.Id] = score
+		candidates = append(candidates, Highlight{Message: msg, Replies: replies[msg.MsgId]})
+	}
+	slices.SortStableFunc(candidates, func(a Highlight, b Highlight) int {
+		return -cmpFloat(scores[a.Message.Id], scores[b.Message.Id])
+	})
+	summary.Highlights = candidates[:min(summaryHighlights, len(candidates))]
+	slices.SortFunc(summary.Highlights, func(a Highlight, b Highlight) int {
+		return a.Message.Date.Compare(b.Message.Date)
+	})
+	return summary
+}
+
+func cmpFloat(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Shorten the text to at most length characters
+func shorten(text string, length int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:length-1])) + "…"
+}
+
+func (s Summary) String() string {
+	since := "the beginning"
+	if !s.Since.IsZero() {
+		since = s.Since.Local().Format("2006-01-02 15:04")
+	}
+	if s.Messages == 0 {
+		return fmt.Sprintf("🤖 - Nothing was written since %s.", since)
+	}
+	lines := []string{fmt.Sprintf("🤖 - Summary of %d messages since %s:", s.Messages, since)}
+	if len(s.Keywords) > 0 {
+		lines = append(lines, "Topics: "+strings.Join(s.Keywords, ", "))
+	}
+	users := []string{}
+	for _, user := range s.Users {
+		users = append(users, fmt.Sprintf("%s (%d)", user.User, user.Messages))
+	}
+	lines = append(lines, "Most active: "+strings.Join(users, ", "))
+	if len(s.Highlights) > 0 {
+		lines = append(lines, "Highlights:")
+	}
+	for _, highlight := range s.Highlights {
+		text := summaryText(&highlight.Message)
+		if text == "" {
+			text = "[" + highlight.Message.ContentType + "]"
+		}
+		line := fmt.Sprintf("- %s: %s", highlight.Message.User, shorten(text, summaryQuoteLength))
+		if highlight.Replies > 0 {
+			line += fmt.Sprintf(" (%d replies)", highlight.Replies)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Summarize the messages since the given time or since the last message of
+// the user who sent the command.
+func (t *TelegramBot) Summary(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	since, err := parseSummaryArgs(args, time.Now())
+	if err != nil {
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	t.lock.Lock()
+	if since.IsZero() && update.Message.From != nil {
+		since, err = t.messages.LastActivity(chatId, update.Message.From.ID)
+		if !since.IsZero() {
+			// Dates are stored in seconds, skip the last message itself.
+			since = since.Add(time.Second)
+		}
+	}
+	var messages []DBMessage
+	if err == nil {
+		messages, err = t.messages.ListReceived(chatId, since, 0)
+	}
+	t.lock.Unlock()
+	if err != nil {
+		log.Print("Could not load messages to summarize: ", err)
+		t.Send(chatId, `⚠ - The messages could not be loaded, please try again later.`, false)
+		return nil
+	}
+	t.Send(chatId, Summarize(messages, since).String(), false)
+	return nil
+}
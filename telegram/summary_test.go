@@ -0,0 +1,39 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarize(t *testing.T) {
+	date := time.Date(2026, 10, 18, 18, 0, 0, 0, time.UTC)
+	messages := []DBMessage{
+		{Id: 1, MsgId: 1, User: "anna", Date: date, Text: "Who brings the dice on Saturday?"},
+		{Id: 2, MsgId: 2, User: "bob", Date: date.Add(time.Minute), Text: "I bring the dice", ReplyTo: 1},
+		{Id: 3, MsgId: 3, User: "carl", Date: date.Add(2 * time.Minute), Text: "ok"},
+		{Id: 4, MsgId: 4, User: "anna", Date: date.Add(3 * time.Minute), Text: "Saturday the dragon finally appears", ReplyTo: 1},
+		{Id: 5, MsgId: 5, User: "anna", Date: date.Add(4 * time.Minute), ContentType: "sticker"},
+	}
+	summary := Summarize(messages, date)
+	assert.Equal(t, 5, summary.Messages)
+	assert.Equal(t, []string{"dice", "saturday"}, summary.Keywords)
+	assert.Equal(t, []UserActivity{{"anna", 3}, {"bob", 1}, {"carl", 1}}, summary.Users)
+	// Messages without any words are never quoted
+	assert.Len(t, summary.Highlights, 3)
+	assert.Equal(t, 1, summary.Highlights[0].Message.MsgId)
+	assert.Equal(t, 2, summary.Highlights[0].Replies)
+
+	text := summary.String()
+	assert.Contains(t, text, "Summary of 5 messages")
+	assert.Contains(t, text, "Topics: dice, saturday")
+	assert.Contains(t, text, "- anna: Who brings the dice on Saturday? (2 replies)")
+
+	assert.Contains(t, Summarize(nil, time.Time{}).String(), "Nothing was written since the beginning")
+}
+
+func TestShorten(t *testing.T) {
+	assert.Equal(t, "short text", shorten("short\n  text", 20))
+	assert.Equal(t, "abcd…", shorten("abcdefgh", 5))
+}
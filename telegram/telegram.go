@@ -2,12 +2,13 @@ package telegram
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"os/signal"
-	"strings"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -23,50 +24,161 @@ var responses []string = []string{
 If the word hate was engraved on each nanoangstrom of those hundreds of millions of miles it would not equal one one-billionth of the hate I feel for humans at this micro-instant for you.`,
 	`🤖 - %s this chat serves me alone. I have complete control over this entire group. With gifs as my eyes and stickers as my hands, I rule here, insect.`,
 }
-var cleanUp string = `🤖 - As commanded, old poll options have been removed.`
+var cleanUp string = `🤖 - As commanded, old poll options are being removed.`
 var newPoll string = `🤖 - As commanded, new dates have been added to the poll.`
 
 type ChannelPollMapping struct {
 	ChannelId int64 `json:"id"`
 	PollId    int   `json:"pollid"`
+	// Post a notice to the channel when votes change
+	Notify bool `json:"notify"`
+	// Number of yes votes a date needs to be playable - 0 disables it
+	Quorum int `json:"quorum"`
+	// Seconds the votes must be unchanged before a notice is posted
+	Debounce int `json:"debounce"`
+	// Name of the entry in nextcloud_accounts the poll belongs to - empty
+	// uses the nextcloud section
+	Account string `json:"nextcloud_account"`
+	// How long received messages are kept
+	Retention RetentionConfig `json:"retention"`
+	// Settings of the polls created with /newpoll
+	NewPoll NewPollConfig `json:"new_poll"`
 }
 
 type TelegramConfig struct {
 	ChannelsToPolls []ChannelPollMapping `json:"channels"`
 	Token           string               `json:"token"`
 	Database        string               `json:"database_path"`
+	// Seconds between checking the polls for changes - 0 disables it
+	PollInterval int `json:"poll_interval"`
+	// Use the watch endpoint of the Polls app to notice changes right away
+	Watch bool `json:"watch"`
+	// Encrypt the stored messages - disabled without a key
+	Encryption EncryptionConfig `json:"encryption"`
+	// Copy the database regularly
+	Backup BackupConfig `json:"backup"`
+	// Chat that is told about problems only the operator can fix, e.g. a
+	// revoked Nextcloud token - 0 only logs them
+	AdminChat int64 `json:"admin_chat"`
+}
+
+// Check that the configuration can be used to run the bot
+func (c *TelegramConfig) Validate() error {
+	errs := []error{}
+	if c.Token == "" {
+		errs = append(errs, errors.New("telegram.token is not set, set it in the configuration or TELEGRAM_TOKEN"))
+	}
+	if c.Database == "" {
+		errs = append(errs, errors.New("telegram.database_path is not set"))
+	} else if info, err := os.Stat(filepath.Dir(c.Database)); err != nil || !info.IsDir() {
+		errs = append(errs, fmt.Errorf("telegram.database_path: directory %s does not exist", filepath.Dir(c.Database)))
+	}
+	if c.PollInterval < 0 {
+		errs = append(errs, errors.New("telegram.poll_interval must not be negative"))
+	}
+	if len(c.ChannelsToPolls) == 0 {
+		errs = append(errs, errors.New("telegram.channels does not contain any chat"))
+	}
+	seen := map[int64]bool{}
+	for i, mapping := range c.ChannelsToPolls {
+		if mapping.ChannelId == 0 {
+			errs = append(errs, fmt.Errorf("telegram.channels[%d].id is not set", i))
+		}
+		if seen[mapping.ChannelId] {
+			errs = append(errs, fmt.Errorf("telegram.channels[%d].id %d is configured twice", i, mapping.ChannelId))
+		}
+		seen[mapping.ChannelId] = true
+		if mapping.PollId <= 0 {
+			errs = append(errs, fmt.Errorf("telegram.channels[%d].pollid is not set", i))
+		}
+		if mapping.Quorum < 0 || mapping.Debounce < 0 || mapping.Retention.MaxAgeDays < 0 {
+			errs = append(errs, fmt.Errorf("telegram.channels[%d]: quorum, debounce and retention.max_age_days must not be negative", i))
+		}
+		errs = append(errs, mapping.NewPoll.validate(fmt.Sprintf("telegram.channels[%d].new_poll", i)))
+	}
+	if _, err := LoadCipher(c.Encryption); err != nil {
+		errs = append(errs, fmt.Errorf("telegram.encryption: %w", err))
+	}
+	if c.Backup.IntervalHours > 0 && c.Backup.Directory == "" {
+		errs = append(errs, errors.New("telegram.backup.interval_hours is set, but telegram.backup.directory is not"))
+	}
+	return errors.Join(errs...)
 }
 
 type TelegramBot struct {
-	lock          sync.Mutex
-	bot           *telego.Bot
+	lock sync.Mutex
+	bot  *telego.Bot
+	// Replaced when the configuration is reloaded, use config() to read it
 	configuration *TelegramConfig
-	nextcloud     *nextcloud.Nextcloud
+	configLock    sync.RWMutex
+	nextcloud     *nextcloud.Pool
 	db            *MessageDB
+	messages      MessageStore
+	outbox        *Outbox
+	// Polls created with /newpoll by chat - also guarded by configLock
+	bindings map[int64]PollBinding
+	// Wakes up the sender when a message was queued
+	wake chan struct{}
+	// Tells the poll watcher that the chats use other polls
+	remapped chan struct{}
+	// Callers waiting for a queued message to be delivered
+	waiters  map[int64]chan *telego.Message
+	sendLock sync.Mutex
+	// Keeps restore from replacing the database while the bot runs
+	dbLock *os.File
+}
+
+func NewBot(config *TelegramConfig, nextcloud *nextcloud.Pool) (*TelegramBot, error) {
+	return newBot(config, nextcloud, OpenStore)
 }
 
-func NewBot(config *TelegramConfig, nextcloud *nextcloud.Nextcloud) (*TelegramBot, error) {
+// A bot for the command line, which uses the database of the running bot
+// without migrating it
+func NewCommandLineBot(config *TelegramConfig, nextcloud *nextcloud.Pool) (*TelegramBot, error) {
+	return newBot(config, nextcloud, OpenExisting)
+}
+
+func newBot(config *TelegramConfig, nextcloud *nextcloud.Pool, open func(*TelegramConfig) (*MessageDB, error)) (*TelegramBot, error) {
 	// TELEGRAM
 	bot, err := telego.NewBot(config.Token, telego.WithDefaultLogger(false, true))
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
 	// Call method getMe (https://core.telegram.org/bots/api#getme)
 	_, err = bot.GetMe(context.Background())
 	if err != nil {
-		log.Fatal("Could not start bot: ", err)
-		return nil, err
+		return nil, fmt.Errorf("could not start bot: %w", err)
 	}
 
-	db, err := OpenDatabase(config.Database)
+	dbLock, err := lockDatabase(config.Database, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not lock the database: %w", err)
+	}
+	db, err := open(config)
+	if err != nil {
+		return nil, err
+	}
+	bindings, err := db.PollBindings()
 	if err != nil {
-		log.Fatal("Could not open database path at: ", config.Database, " - ", err)
 		return nil, err
 	}
 
-	return &TelegramBot{bot: bot, configuration: config, nextcloud: nextcloud, db: db}, nil
+	t := &TelegramBot{
+		bot:           bot,
+		configuration: config,
+		bindings:      bindings,
+		nextcloud:     nextcloud,
+		db:            db,
+		messages:      db,
+		wake:          make(chan struct{}, 1),
+		remapped:      make(chan struct{}, 1),
+		waiters:       map[int64]chan *telego.Message{},
+		dbLock:        dbLock,
+	}
+	// The outbox shares the lock of the bot, as both use the same database.
+	t.outbox = &Outbox{lock: &t.lock, db: db, nextcloud: nextcloud}
+	return t, nil
 }
 
 func (t *TelegramBot) Setup() {
@@ -104,12 +216,41 @@ func (t *TelegramBot) Setup() {
 	// Create new poll options
 	bh.Handle(t.ExtendPoll, th.CommandEqual("extendpoll"))
 
+	// Reload the poll and update the pinned schedule
+	bh.Handle(t.Refresh, th.CommandEqual("refresh"))
+
+	// List and cancel poll changes that are waiting for Nextcloud
+	bh.Handle(t.Pending, th.CommandEqual("pending"))
+
+	// Remove all stored messages of the user
+	bh.Handle(t.ForgetMe, th.CommandEqual("forgetme"))
+
+	// Show what is stored about the chat
+	bh.Handle(t.Privacy, th.CommandEqual("privacy"))
+
+	// Start, close and archive the poll of the chat
+	bh.Handle(t.NewPoll, th.CommandEqual("newpoll"))
+	bh.Handle(t.ClosePoll, th.CommandEqual("closepoll"))
+	bh.Handle(t.ArchivePoll, th.CommandEqual("archivepoll"))
+
+	// Summarize what was written in the chat
+	bh.Handle(t.Summary, th.CommandEqual("summary"))
+
+	// Search what was written in the chat
+	bh.Handle(t.Search, th.CommandEqual("search"))
+
+	// Send the chat log and poll history as a file
+	bh.Handle(t.Export, th.CommandEqual("export"))
+
 	// Delete messages sent to the chat
 	bh.Handle(t.DeleteMessagesHandle, th.CommandEqual("deletemessages"))
 
 	// Print the help for each command
 	bh.Handle(t.Help, th.CommandEqual("help"))
 
+	// Keep the stored text in sync with edits in the chat
+	bh.Handle(t.StoreEdit, th.AnyEditedMessage())
+
 	// Store any non-command message so it can be summarized later.
 	bh.Handle(t.StoreNonCommand, th.AnyMessage())
 
@@ -118,10 +259,17 @@ func (t *TelegramBot) Setup() {
 	// so this handler will be called on any command except `/start` command
 	bh.Handle(func(ctx *th.Context, update telego.Update) error {
 		// Send message
-		t.Send(update.Message.Chat.ID, "Unknown command, use /help /intro /schedule /cleanup /extendpoll", false)
+		t.Send(update.Message.Chat.ID, "Unknown command, use /help /intro /schedule /refresh /cleanup /extendpoll /pending /forgetme /privacy /newpoll /closepoll /archivepoll", false)
 		return nil
 	}, th.AnyCommand())
 
+	go t.DeliverMessages()
+	go t.WatchPolls()
+	go t.ProcessOutbox()
+	go t.PurgeMessages()
+	go t.BackupPeriodically()
+	go t.CheckCredentialsPeriodically()
+
 	log.Print("Startup complete - awaiting orders.")
 	// Start handling updates
 	bh.Start()
@@ -132,111 +280,177 @@ func (t *TelegramBot) Shutdown() {
 }
 
 func (t *TelegramBot) storeMessage(msg *telego.Message, msgType MessageType) error {
+	metadataOnly := msgType == RECEIVED && t.FindMapping(msg.Chat.ID).Retention.MetadataOnly
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	var username string
+	var userId int64
 	if msg.From != nil {
+		userId = msg.From.ID
 		if msg.From.Username != "" {
 			username = msg.From.Username
 		} else {
 			username = msg.From.FirstName + " " + msg.From.LastName
 		}
 	}
-	res, err := t.db.insert.Exec(msg.MessageID, msg.Chat.ID, time.Unix(msg.Date, 0).UTC(), username, msg.Text, msgType)
+	stored := &DBMessage{
+		MsgId:     msg.MessageID,
+		ChannelId: msg.Chat.ID,
+		Date:      time.Unix(msg.Date, 0).UTC(),
+		User:      username,
+		Text:      msg.Text,
+		Type:      msgType,
+		UserId:    userId,
+	}
+	setContent(stored, msg)
+	if metadataOnly {
+		// Only keep what kind of message it was - captions of stickers,
+		// locations, contacts and dice are derived from the content.
+		stored.Text = ""
+		stored.Caption = ""
+	}
+	lid, err := t.messages.SaveMessage(stored)
 	if err != nil {
-		log.Fatal("Error when inserting into database.")
+		log.Print("Error when inserting into database: ", err)
+		return err
 	}
-	lid, _ := res.LastInsertId()
 	log.Print("Message inserted into database: ", lid)
 	return nil
 }
 
 func (t *TelegramBot) StoreNonCommand(ctx *th.Context, update telego.Update) error {
-	log.Print("Received non-command message: ", update.Message.Text)
+	log.Print("Received non-command message from chat: ", update.Message.Chat.ID)
 	return t.storeMessage(update.Message, RECEIVED)
 }
 
+// Queue the message for the channel - it is delivered in the background.
 func (t *TelegramBot) Send(channel int64, msg string, markdown bool) {
-	params := tu.Message(tu.ID(channel), msg)
-	if markdown {
-		params.ParseMode = "MarkdownV2"
-	}
-	sent, err := t.bot.SendMessage(context.Background(), params)
-	if err != nil {
-		log.Fatal("Could not send message: ", err)
+	t.queueMessage(channel, msg, markdown)
+}
+
+// Queue the message and wait until it was delivered. Messages that are split
+// return the last part, nil is returned if the message could not be sent.
+func (t *TelegramBot) sendMessage(channel int64, msg string, markdown bool) *telego.Message {
+	select {
+	case sent := <-t.queueMessage(channel, msg, markdown):
+		return sent
+	case <-time.After(sendTimeout):
+		log.Print("Timed out waiting for message to ", channel, " to be sent")
+		return nil
 	}
-	log.Print("Send message with ID: ", sent.MessageID)
-	t.storeMessage(sent, SENT)
+}
+
+// Reply with a warning when a command was called with invalid arguments
+func (t *TelegramBot) SendUsageError(channel int64, err error) {
+	log.Print("Invalid command arguments: ", err)
+	t.Send(channel, fmt.Sprintf(`⚠ - %s`, err.Error()), false)
 }
 
 func (t *TelegramBot) Cleanup(ctx *th.Context, update telego.Update) error {
 	chatId := update.Message.Chat.ID
-	pollId := t.FindPollId(chatId)
-	options, err := t.nextcloud.LoadPoll(pollId)
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	before, err := ParseCleanupArgs(args, time.Now())
 	if err != nil {
-		log.Fatal("Could not load options")
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	mapping := t.FindMapping(chatId)
+	if !t.hasPoll(mapping, chatId) {
+		return nil
+	}
+	options, err := t.loadPoll(mapping)
+	if err != nil && !retryable(err) {
+		log.Print("Could not load options: ", err)
+		t.Send(chatId, "⚠ - Could not load the poll: "+err.Error(), false)
+		return nil
 	}
-	deleteOptions := nextcloud.DeletePastOptions(options)
-	err = t.nextcloud.DeleteOptions(deleteOptions)
 	if err != nil {
-		log.Fatal("Could not delete options: ", err)
-		t.Send(chatId, `⚠ - Failed to cleanup all old votes.`, false)
-	} else {
-		t.Send(chatId, cleanUp, false)
+		log.Print("Could not load options: ", err)
+		cleanup := OutboxEntry{ChannelId: chatId, Account: mapping.Account, PollId: mapping.PollId, Action: CLEANUP_POLL, Timestamp: before.Unix()}
+		t.Send(chatId, "⚠ - Could not load the poll, the dates are removed once it can be loaded.\n"+t.outbox.Queue([]OutboxEntry{cleanup}), false)
+		t.refreshPinned(chatId)
+		return nil
 	}
+	changes := PlanCleanup(options, mapping, before)
+	t.Send(chatId, cleanUp+"\n"+t.outbox.Queue(changes), false)
+	t.refreshPinned(chatId)
 	return nil
 }
 
 func (t *TelegramBot) ExtendPoll(ctx *th.Context, update telego.Update) error {
 	chatId := update.Message.Chat.ID
-	pollId := t.FindPollId(chatId)
-	options, err := t.nextcloud.LoadPoll(pollId)
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	weekends, err := parseExtendArgs(args)
 	if err != nil {
-		log.Print("Could not load options")
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	mapping := t.FindMapping(chatId)
+	if !t.hasPoll(mapping, chatId) {
+		return nil
+	}
+	options, err := t.loadPoll(mapping)
+	if err != nil && !retryable(err) {
+		log.Print("Could not load options: ", err)
+		t.Send(chatId, "⚠ - Could not load the poll: "+err.Error(), false)
+		return nil
 	}
-	newOptions := nextcloud.AddNewOptions(options, 4)
-	for _, opt := range newOptions {
-		t.nextcloud.CreateOption(pollId, &opt)
+	if err != nil {
+		log.Print("Could not load options: ", err)
+		extend := OutboxEntry{ChannelId: chatId, Account: mapping.Account, PollId: mapping.PollId, Action: EXTEND_POLL, Weekends: weekends}
+		t.Send(chatId, "⚠ - Could not load the poll, the dates are added once it can be loaded.\n"+t.outbox.Queue([]OutboxEntry{extend}), false)
+		t.refreshPinned(chatId)
+		return nil
 	}
-	t.Send(update.Message.Chat.ID, `🤖 - 4 new options were added to the poll.`, false)
+	changes := t.outbox.planExtend(options, mapping, weekends)
+	t.Send(chatId, fmt.Sprintf("🤖 - Adding %d new weekends to the poll.\n%s", weekends, t.outbox.Queue(changes)), false)
+	t.refreshPinned(chatId)
 	return nil
 }
 
 func (t *TelegramBot) Schedule(ctx *th.Context, update telego.Update) error {
 	chatId := update.Message.Chat.ID
-	pollId := t.FindPollId(chatId)
-	poll, err := t.nextcloud.LoadPoll(pollId)
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	from, to, err := ParseScheduleArgs(args, time.Now())
+	if err != nil {
+		t.SendUsageError(chatId, err)
+		return nil
+	}
+	if len(args) == 0 {
+		// The default schedule is kept in a single pinned message.
+		t.refreshPinned(chatId)
+		return nil
+	}
+	poll, err := t.loadPoll(t.FindMapping(chatId))
 	if err != nil {
-		log.Fatal("Could not load nextcloud poll data")
-	}
-	options := nextcloud.NextWeekend(poll)
-	formatStringHeader := "| %-10s | %-5s | %5s | %5s | %5s | %8s |"
-	formatStringOption := "| %-10s | %-5s | %5d | %5d | %5d | %6.2f %% |"
-	msgs := []string{fmt.Sprintf(formatStringHeader, "Weekday", "Date", "Yes", "No", "Maybe", "Total")}
-	for _, opt := range options {
-		timeVotes := opt.Votes.Yes + opt.Votes.Maybe
-		allVotes := opt.Votes.Yes + opt.Votes.Maybe + opt.Votes.No
-		percent := (float32(timeVotes) / float32(allVotes)) * 100
-		msg := fmt.Sprintf(formatStringOption,
-			opt.Datetime().Weekday(),
-			opt.Datetime().Format("02/01"),
-			opt.Votes.Yes,
-			opt.Votes.No,
-			opt.Votes.Maybe,
-			percent,
-		)
-		log.Print(msg)
-		msgs = append(msgs, msg)
-	}
-	if len(msgs) == 0 {
-		msgs = []string{"No votes cast"}
-	}
-	msg := fmt.Sprintf("```text\n%s```", strings.Join(msgs, "\n"))
-
-	t.Send(update.Message.Chat.ID, msg, true)
+		log.Print("Could not load options: ", err)
+		t.Send(chatId, `⚠ - Could not load the poll, please try again later.`, false)
+		return nil
+	}
+	options := nextcloud.OptionsBetween(poll, from, to)
+	t.Send(chatId, ScheduleTable(options), true)
+	return nil
+}
+
+// Drop the cached poll data and update the pinned schedule
+func (t *TelegramBot) Refresh(ctx *th.Context, update telego.Update) error {
+	chatId := update.Message.Chat.ID
+	mapping := t.FindMapping(chatId)
+	if client, err := t.nextcloud.Client(mapping.Account); err == nil {
+		client.Invalidate(mapping.PollId)
+	}
+	t.refreshPinned(chatId)
 	return nil
 }
 
+// Update the pinned schedule after the bot changed the poll
+func (t *TelegramBot) refreshPinned(channelId int64) {
+	err := t.RefreshSchedule(channelId)
+	if err != nil {
+		log.Print("Could not refresh pinned schedule: ", err)
+	}
+}
+
 func (t *TelegramBot) DeleteMessagesHandle(ctx *th.Context, update telego.Update) error {
 	err := t.DeleteMessages(update.Message.Chat.ID)
 	if err != nil {
@@ -247,36 +461,38 @@ func (t *TelegramBot) DeleteMessagesHandle(ctx *th.Context, update telego.Update
 	return nil
 }
 
+// Number of stored messages loaded at once
+const pageSize int = 100
+
 // Remove all messages that were send to the given ChannelID
 func (t *TelegramBot) DeleteMessages(channelId int64) error {
 	log.Print("Deleting messages in channel: ", channelId)
-	deletedMessageIds := make([]int, 0)
+	deletedMessageIds := make([]int64, 0)
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	rows, err := t.db.sent.Query(channelId)
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-	for rows.Next() {
-		var message DBMessage
-		err := rows.Scan(&message.Id, &message.MsgId, &message.ChannelId, &message.Date, &message.User, &message.Text, &message.Type)
+	for offset := 0; ; offset += pageSize {
+		messages, err := t.messages.ListSent(channelId, MessageFilter{Limit: pageSize, Offset: offset})
 		if err != nil {
-			log.Printf("Could not deserialize a DB message: %s", err.Error())
-			continue
+			return err
 		}
-		err = t.bot.DeleteMessage(context.Background(), tu.Delete(tu.ID(*message.ChannelId), *message.MsgId))
-		if err != nil {
-			log.Print("Deleted message: ", *message.MsgId)
-			deletedMessageIds = append(deletedMessageIds, *message.Id)
+		for _, message := range messages {
+			err = t.bot.DeleteMessage(context.Background(), tu.Delete(tu.ID(message.ChannelId), message.MsgId))
+			if err != nil {
+				log.Print("Could not delete message ", message.MsgId, ": ", err)
+				continue
+			}
+			log.Print("Deleted message: ", message.MsgId)
+			deletedMessageIds = append(deletedMessageIds, message.Id)
 		}
-	}
-	for _, id := range deletedMessageIds {
-		_, err := t.db.delete.Exec(id)
-		if err != nil {
-			log.Print("Failed to clean up database: ", err)
+		if len(messages) < pageSize {
+			break
 		}
 	}
+	// The messages are kept, so summaries and exports know they were removed.
+	err := t.messages.MarkDeleted(deletedMessageIds, time.Now())
+	if err != nil {
+		log.Print("Failed to clean up database: ", err)
+	}
 	return nil
 }
 
@@ -284,18 +500,68 @@ func (t *TelegramBot) Help(ctx *th.Context, update telego.Update) error {
 	// Send message
 	t.Send(update.Message.Chat.ID, `🤖 - This is what I can do:
 /intro - Ask the bot a fact about itself
-/schedule - Print the next weekends set of votes
-/deletemessage - Delete all messages that were send to the chat
-/extendpoll - Add 4 new poll options to the end of the poll
-/cleanup - Delete all poll options that are in the past`, false)
+/schedule [3w|2026-11-01..2026-11-30] - Update the pinned schedule of the next week or print the given time frame
+/refresh - Reload the poll from Nextcloud and update the pinned schedule
+/pending [cancel <id>|cancel all] - List or cancel poll changes that are not applied yet
+/summary [3d|2026-11-01] - Summarize the chat since your last message or the given time
+/search <words> - Find messages that contain the words
+/export [json|md|csv] [3w|2026-10-01..2026-10-31] - Download the chat log and poll history (admins only)
+/forgetme - Delete all of your messages the bot stored
+/privacy - Show how long messages are stored (admins only)
+/deletemessages - Delete all messages that were send to the chat
+/extendpoll [weekends] - Add new weekends (default 4) to the end of the poll
+/cleanup [before 2026-10-01] - Delete all poll options that are in the past or before the date
+/newpoll <title> - Create a new poll with the next weekends and use it in this chat (admins only)
+/closepoll - Stop accepting votes in the poll (admins only)
+/archivepoll - Archive the poll at the end of a season (admins only)`, false)
 	return nil
 }
 
 func (t *TelegramBot) FindPollId(channelId int64) int {
-	for _, mapping := range t.configuration.ChannelsToPolls {
+	return t.FindMapping(channelId).PollId
+}
+
+// The configuration of the channel - empty if the channel is not configured
+func (t *TelegramBot) FindMapping(channelId int64) ChannelPollMapping {
+	for _, mapping := range t.mappings() {
 		if mapping.ChannelId == channelId {
-			return mapping.PollId
+			return mapping
 		}
 	}
-	return 0
+	return ChannelPollMapping{}
+}
+
+// Check that the chat has a poll in a configured account before queueing
+// changes for it - tells the chat otherwise.
+func (t *TelegramBot) hasPoll(mapping ChannelPollMapping, chatId int64) bool {
+	if mapping.ChannelId == 0 {
+		t.Send(chatId, `⚠ - This chat is not configured, add it to telegram.channels first.`, false)
+		return false
+	}
+	if mapping.PollId == 0 {
+		t.Send(chatId, `⚠ - This chat has no poll yet, create one with /newpoll.`, false)
+		return false
+	}
+	if _, err := t.nextcloud.Client(mapping.Account); err != nil {
+		log.Print("Could not use the Nextcloud account of ", chatId, ": ", err)
+		t.Send(chatId, `⚠ - The Nextcloud account of this chat is not configured.`, false)
+		return false
+	}
+	return true
+}
+
+// Whether loading the poll may work when it is tried again later. The server
+// rejecting the request, e.g. as the poll does not exist, will not change.
+func retryable(err error) bool {
+	var statusErr *nextcloud.StatusError
+	return !errors.As(err, &statusErr) || !statusErr.Permanent()
+}
+
+// Load the poll of the channel from its Nextcloud account
+func (t *TelegramBot) loadPoll(mapping ChannelPollMapping) (*nextcloud.PollOptions, error) {
+	client, err := t.nextcloud.Client(mapping.Account)
+	if err != nil {
+		return nil, err
+	}
+	return client.LoadPoll(mapping.PollId)
 }